@@ -7,28 +7,35 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"go.uber.org/zap"
 	"knative.dev/pkg/logging"
 )
 
-// TODO:
-// - Also support anonymous and Basic-type auth?
-// - take a config for registries/repos to redirect from/to.
-
 var (
+	// config is the path to a YAML or JSON file describing every route to
+	// serve. If set, -repo, -gcr and -prefix are ignored.
+	config = flag.String("config", "", "path to a YAML or JSON routing config")
+
 	// Redirect requests for example.dev/static -> ghcr.io/static
 	// If repo is empty, example.dev/foo/bar -> ghcr.io/foo/bar
 	repo = flag.String("repo", "", "repo to redirect to")
 
-	// TODO(jason): Support arbitrary registries.
+	// Other registries can be configured with -config.
 	gcr = flag.Bool("gcr", false, "if true, use GCR mode")
 
 	// prefix is the user-visible repo prefix.
@@ -41,9 +48,48 @@ var (
 	// - example.dev/foo/bar -> ghcr.io/distroless/foo/bar
 	// (this is for backward compatibility with prefix-less redirects)
 	prefix = flag.String("prefix", "", "if set, user-visible repo prefix")
+
+	// adminAddr serves debugging endpoints, which shouldn't be public.
+	adminAddr = flag.String("admin-addr", "", "if set, address to serve admin endpoints on, e.g. localhost:9090")
+
+	// reloadInterval is how often -config is checked for changes. The config
+	// is also reloaded on SIGHUP.
+	reloadInterval = flag.Duration("reload-interval", 10*time.Second, "how often to check -config for changes, or 0 to only reload on SIGHUP")
+
+	// keychain lets a local instance front private registries with the
+	// operator's own logins, like a local mirror.
+	keychain = flag.Bool("keychain", false, "if true, use credentials from ~/.docker/config.json and its credential helpers for upstreams, like crane")
+
+	// tlsCert and tlsKey make the redirector terminate TLS itself, which is
+	// needed to verify client certificates.
+	tlsCert = flag.String("tls-cert", "", "if set, path to a PEM certificate to serve TLS with")
+	tlsKey  = flag.String("tls-key", "", "if set, path to the PEM private key of -tls-cert")
+
+	// clientCA requires clients to present certificates it signed, which
+	// the config's clientCerts authorize.
+	clientCA = flag.String("client-ca", "", "if set, path to PEM CA certificates client certificates must be signed by; requires -tls-cert")
 )
 
 func main() {
+	// registry-redirect resolve [flags] <host>/<ref>...
+	if len(os.Args) > 1 && os.Args[1] == "resolve" {
+		if err := resolve(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// registry-redirect apikey
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		key, hash, err := redirect.NewAPIKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("key:  %s\nhash: %s\n", key, hash)
+		return
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
@@ -62,14 +108,138 @@ func main() {
 	}
 }
 
-func serve(ctx context.Context, logger *zap.SugaredLogger) (err error) {
-	flag.Parse()
+// loadConfig returns the routing config from -config if set, or else the
+// single route described by -repo, -gcr and -prefix.
+func loadConfig() (*redirect.Config, error) {
+	if *config != "" {
+		return redirect.LoadConfig(*config)
+	}
 	host := "ghcr.io"
 	if *gcr {
 		host = "gcr.io"
 	}
-	r := redirect.New(host, *repo, *prefix)
-	http.Handle("/", r)
+	cfg := redirect.FlagConfig(host, *repo, *prefix)
+	return &cfg, nil
+}
+
+// resolve prints how each reference in args would be redirected, given the
+// same flags as serving, without contacting any upstream.
+func resolve(args []string, w io.Writer) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if flag.NArg() == 0 {
+		return errors.New("usage: registry-redirect resolve [flags] <host>/<repo>[:<tag>|@<digest>]...")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	for _, ref := range flag.Args() {
+		res, err := redirect.Resolve(*cfg, ref, redirect.WithRegion(region()))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", ref)
+		if res.Rejected != "" {
+			fmt.Fprintf(w, "  rejected: %s\n", res.Rejected)
+			continue
+		}
+		fmt.Fprintf(w, "  route: host=%q prefix=%q upstream=%q repo=%q\n",
+			res.Route.Host, res.Route.Prefix, res.Route.Upstream, res.Route.Repo)
+		for _, up := range res.Upstreams {
+			fmt.Fprintf(w, "  upstream %s:\n", up.Upstream)
+			fmt.Fprintf(w, "    manifest: %s\n", up.ManifestURL)
+			fmt.Fprintf(w, "    scope:    %s\n", up.Scope)
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS config to serve with, which requires client
+// certificates signed by -client-ca, if it's set.
+func tlsConfig() (*tls.Config, error) {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if *clientCA == "" {
+		return nil, nil
+	}
+	if *tlsCert == "" {
+		return nil, errors.New("-client-ca requires -tls-cert and -tls-key")
+	}
+	b, err := os.ReadFile(*clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %s", *clientCA)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// region returns the region this instance runs in, from $REGION, or from
+// $FLY_REGION when deployed to Fly.io.
+func region() string {
+	if r := os.Getenv("REGION"); r != "" {
+		return r
+	}
+	return os.Getenv("FLY_REGION")
+}
+
+func serve(ctx context.Context, logger *zap.SugaredLogger) (err error) {
+	flag.Parse()
+	region := region()
+	opts := []redirect.Option{redirect.WithRegion(region)}
+	if *keychain {
+		opts = append(opts, redirect.WithKeychain(authn.DefaultKeychain))
+	}
+	r, err := redirect.NewReloader(loadConfig, opts...)
+	if err != nil {
+		return err
+	}
+	logger.Infof("serving %d routes in region %q", len(r.Config().Routes), region)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			if err := r.Reload(); err != nil {
+				logger.Errorw("reloading failed; keeping the current config", "error", err)
+				continue
+			}
+			logger.Infof("reloaded config, serving %d routes", len(r.Config().Routes))
+		}
+	}()
+	if *config != "" && *reloadInterval > 0 {
+		go r.Watch(ctx, *config, *reloadInterval)
+	}
+
+	if *adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/resolve", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			redirect.ResolveHandler(r.Config(), redirect.WithRegion(region)).ServeHTTP(w, req)
+		}))
+		admin.Handle("/debug/vars", expvar.Handler())
+		adminSrv := &http.Server{Addr: *adminAddr, Handler: admin}
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("admin listen:%+s\n", err)
+			}
+		}()
+		defer adminSrv.Close()
+		logger.Infof("admin server listening on: %s", *adminAddr)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -77,11 +247,24 @@ func serve(ctx context.Context, logger *zap.SugaredLogger) (err error) {
 	}
 	logger.Info("http server starting...")
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", port),
-		Handler: nil,
+		Addr: fmt.Sprintf(":%s", port),
+		// Not the default mux, which expvar adds /debug/vars to: that's only
+		// served by the admin server.
+		Handler: r,
+	}
+	if srv.TLSConfig, err = tlsConfig(); err != nil {
+		return err
+	}
+	if len(r.Config().ClientCerts) != 0 && *clientCA == "" {
+		return errors.New("clientCerts are configured, but -client-ca isn't set")
 	}
 	go func() {
-		if err = srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if *tlsCert != "" {
+			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("listen:%+s\n", err)
 		}
 	}()
@@ -0,0 +1,123 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIKey allows whoever has the key to take actions on some repos. Keys are
+// presented as the password of Basic credentials, like with docker login,
+// and the username is ignored.
+//
+// Only the key's hash is configured, so the config doesn't hold the key
+// itself. Keys are revoked by removing them from the config, or by letting
+// them expire.
+type APIKey struct {
+	// Name identifies the key in logs, and as the subject "apikey:<name>".
+	Name string `json:"name"`
+
+	// Hash is the SHA-256 of the key, as "sha256:<hex>". NewAPIKey
+	// generates keys and their hashes.
+	Hash string `json:"hash"`
+
+	// Repos are globs matching the user-visible repo names the key can
+	// access, like in Grant.
+	Repos []string `json:"repos"`
+
+	// Actions are the actions allowed, "pull" or "push". Defaults to pull.
+	Actions []string `json:"actions,omitempty"`
+
+	// Expires is when the key stops being accepted, in RFC 3339 format,
+	// e.g., 2023-01-01T00:00:00Z. If empty, the key doesn't expire.
+	Expires string `json:"expires,omitempty"`
+}
+
+// NewAPIKey returns a new random API key, and the hash to configure it with.
+func NewAPIKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = "rr_" + base64.RawURLEncoding.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// validate reports the problems with the key's configuration.
+func (k APIKey) validate() []string {
+	var errs []string
+	if k.Name == "" {
+		errs = append(errs, "name is required")
+	}
+	if h := strings.TrimPrefix(k.Hash, "sha256:"); len(h) != 64 || h == k.Hash || strings.Trim(h, "0123456789abcdef") != "" {
+		errs = append(errs, `hash must look like "sha256:<64 lowercase hex digits>"`)
+	}
+	if len(k.Repos) == 0 {
+		errs = append(errs, "at least one of repos is required")
+	}
+	for i, action := range k.Actions {
+		if action != "pull" && action != "push" {
+			errs = append(errs, fmt.Sprintf("actions[%d]: unknown action %q", i, action))
+		}
+	}
+	if k.Expires != "" {
+		if _, err := time.Parse(time.RFC3339, k.Expires); err != nil {
+			errs = append(errs, fmt.Sprintf("expires: %v", err))
+		}
+	}
+	return errs
+}
+
+type apiKey struct {
+	name    string
+	grant   grant
+	expires time.Time
+}
+
+// apiKeyAuthenticator authenticates clients with API keys.
+type apiKeyAuthenticator map[string]apiKey // by hash
+
+func newAPIKeyAuthenticator(keys []APIKey) apiKeyAuthenticator {
+	a := apiKeyAuthenticator{}
+	for _, k := range keys {
+		ak := apiKey{
+			name:  k.Name,
+			grant: newGrant(Grant{Repos: k.Repos, Actions: k.Actions}),
+		}
+		if k.Expires != "" {
+			ak.expires, _ = time.Parse(time.RFC3339, k.Expires)
+		}
+		a[k.Hash] = ak
+	}
+	return a
+}
+
+func (a apiKeyAuthenticator) authenticate(r *http.Request) (identity, bool, error) {
+	_, password, ok := r.BasicAuth()
+	if !ok {
+		return identity{}, false, nil
+	}
+	k, ok := a[hashAPIKey(password)]
+	if !ok {
+		return identity{}, false, nil
+	}
+	if !k.expires.IsZero() && time.Now().After(k.expires) {
+		return identity{}, false, fmt.Errorf("API key %q expired", k.name)
+	}
+	return identity{subject: "apikey:" + k.name, grants: []grant{k.grant}}, true, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+func newKey(t *testing.T) (string, string) {
+	t.Helper()
+	key, hash, err := redirect.NewAPIKey()
+	if err != nil {
+		t.Fatalf("NewAPIKey: %v", err)
+	}
+	return key, hash
+}
+
+func TestAPIKeys(t *testing.T) {
+	up := newFakeUpstream(t)
+	want := up.push(t, "example/partner/engine", "main")
+	up.push(t, "example/internal/engine", "main")
+
+	partner, partnerHash := newKey(t)
+	expired, expiredHash := newKey(t)
+	cfg := redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+		Auth: &redirect.Auth{
+			Issuer:      "https://registry.example.dev",
+			SigningKeys: []string{writeKey(t, "ec")},
+			APIKeys: []redirect.APIKey{{
+				Name:  "partner",
+				Hash:  partnerHash,
+				Repos: []string{"partner/**"},
+			}, {
+				Name:    "expired",
+				Hash:    expiredHash,
+				Repos:   []string{"**"},
+				Expires: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			}},
+		},
+	}
+	current := cfg
+	r, err := redirect.NewReloader(func() (*redirect.Config, error) {
+		c := current
+		return &c, nil
+	})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	s := httptest.NewServer(r)
+	defer s.Close()
+	reg := strings.TrimPrefix(s.URL, "http://")
+
+	pull := func(repo, key string) (string, error) {
+		return crane.Digest(reg+"/"+repo+":main",
+			crane.WithTransport(forwardedHTTP{}),
+			crane.WithAuth(&authn.Basic{Username: "partner", Password: key}))
+	}
+
+	got, err := pull("partner/engine", partner)
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+
+	for _, c := range []struct {
+		desc string
+		repo string
+		key  string
+	}{
+		{"other repo", "internal/engine", partner},
+		{"expired", "partner/engine", expired},
+		{"unknown", "partner/engine", "rr_not-a-key"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			if _, err := pull(c.repo, c.key); err == nil {
+				t.Error("digest: got nil error")
+			}
+
+			// Keys sent directly are checked before anything is sent upstream.
+			n := up.tokenRequests()
+			if got := headManifestAs(t, reg, c.repo, "main", basic("partner", c.key)); got != http.StatusUnauthorized {
+				t.Errorf("status: got %d, want %d", got, http.StatusUnauthorized)
+			}
+			if got := up.tokenRequests(); got != n {
+				t.Errorf("token requests: got %d, want %d", got, n)
+			}
+		})
+	}
+
+	if got := headManifestAs(t, reg, "partner/engine", "main", basic("partner", partner)); got != http.StatusOK {
+		t.Errorf("status: got %d, want %d", got, http.StatusOK)
+	}
+
+	// Keys are revoked by removing them from the config.
+	auth := *cfg.Auth
+	auth.APIKeys = auth.APIKeys[1:]
+	current.Auth = &auth
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := pull("partner/engine", partner); err == nil {
+		t.Error("digest with a revoked key: got nil error")
+	}
+}
+
+func TestAPIKeyValidation(t *testing.T) {
+	_, hash := newKey(t)
+	for _, c := range []struct {
+		desc    string
+		key     redirect.APIKey
+		wantErr string
+	}{
+		{"no name", redirect.APIKey{Hash: hash, Repos: []string{"**"}}, "name is required"},
+		{"plaintext", redirect.APIKey{Name: "k", Hash: "rr_abc", Repos: []string{"**"}}, "hash must look like"},
+		{"uppercase hash", redirect.APIKey{Name: "k", Hash: strings.ToUpper(hash), Repos: []string{"**"}}, "hash must look like"},
+		{"no repos", redirect.APIKey{Name: "k", Hash: hash}, "at least one of repos is required"},
+		{"unknown action", redirect.APIKey{Name: "k", Hash: hash, Repos: []string{"**"}, Actions: []string{"delete"}}, `unknown action "delete"`},
+		{"bad expiry", redirect.APIKey{Name: "k", Hash: hash, Repos: []string{"**"}, Expires: "tomorrow"}, "expires:"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := redirect.Config{
+				Routes: []redirect.Route{{Repo: "example"}},
+				Auth:   &redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, APIKeys: []redirect.APIKey{c.key}},
+			}.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Auth configures the redirector to issue tokens of its own, instead of
+// passing token requests through to upstreams, so access is controlled by
+// its Grants rather than the upstreams' permissions.
+//
+// Clients are then served upstream with the routes' Credentials, if any,
+// or anonymously.
+type Auth struct {
+	// Issuer identifies the redirector as the iss claim of the tokens it
+	// issues, e.g., https://registry.dagger.io
+	Issuer string `json:"issuer"`
+
+	// Service is the service clients request tokens for, and the aud claim
+	// of the tokens. Defaults to Issuer.
+	Service string `json:"service,omitempty"`
+
+	// SigningKeys are the paths of PEM-encoded ECDSA P-256 or RSA private
+	// keys. Tokens are signed with the first, and tokens signed with any of
+	// them are accepted, so keys can be rotated. Every key's public key is
+	// served at /.well-known/jwks.json.
+	SigningKeys []string `json:"signingKeys"`
+
+	// TokenTTL is how long issued tokens last, like "5m", which is the
+	// default.
+	TokenTTL string `json:"tokenTTL,omitempty"`
+
+	// Grants allow clients to pull or push repos. Clients are only allowed
+	// what some grant allows them.
+	Grants []Grant `json:"grants,omitempty"`
+
+	// OIDC are the issuers whose identity tokens clients can authenticate
+	// with.
+	OIDC []OIDCIssuer `json:"oidc,omitempty"`
+
+	// APIKeys are keys clients can authenticate with, each allowing access
+	// to some repos, in addition to any Grants for its subject.
+	APIKeys []APIKey `json:"apiKeys,omitempty"`
+}
+
+// Grant allows clients to take actions on repos.
+type Grant struct {
+	// Anonymous grants access to clients without any credentials.
+	Anonymous bool `json:"anonymous,omitempty"`
+
+	// Subjects grants access to authenticated clients whose subject matches
+	// one of these globs, where * matches anything.
+	Subjects []string `json:"subjects,omitempty"`
+
+	// Repos are globs matching the user-visible repo names access is
+	// granted to, like in Rename: * matches any part of a single path
+	// component, and ** matches anything, including slashes.
+	Repos []string `json:"repos"`
+
+	// Actions are the actions allowed, "pull" or "push". Defaults to pull.
+	Actions []string `json:"actions,omitempty"`
+}
+
+const defaultIssuedTokenTTL = 5 * time.Minute
+
+// validate reports the problems with the auth configuration, without
+// reading any keys.
+func (a Auth) validate() []string {
+	var errs []string
+	if a.Issuer == "" {
+		errs = append(errs, "issuer is required")
+	}
+	if len(a.SigningKeys) == 0 {
+		errs = append(errs, "at least one of signingKeys is required")
+	}
+	if a.TokenTTL != "" {
+		if d, err := time.ParseDuration(a.TokenTTL); err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("tokenTTL: invalid duration %q", a.TokenTTL))
+		}
+	}
+	for i, o := range a.OIDC {
+		for _, err := range o.validate() {
+			errs = append(errs, fmt.Sprintf("oidc[%d]: %s", i, err))
+		}
+	}
+	names := map[string]int{}
+	for i, k := range a.APIKeys {
+		where := fmt.Sprintf("apiKeys[%d]", i)
+		for _, err := range k.validate() {
+			errs = append(errs, fmt.Sprintf("%s: %s", where, err))
+		}
+		if j, ok := names[k.Name]; ok {
+			errs = append(errs, fmt.Sprintf("%s: duplicates name %q of apiKeys[%d]", where, k.Name, j))
+		}
+		names[k.Name] = i
+	}
+	for i, g := range a.Grants {
+		where := fmt.Sprintf("grants[%d]", i)
+		if !g.Anonymous && len(g.Subjects) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: one of anonymous and subjects is required", where))
+		}
+		if len(g.Subjects) != 0 && len(a.OIDC) == 0 && len(a.APIKeys) == 0 {
+			// Without authenticators, no client ever has a subject.
+			errs = append(errs, fmt.Sprintf("%s: subjects require oidc or apiKeys to authenticate clients", where))
+		}
+		if len(g.Repos) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: at least one of repos is required", where))
+		}
+		for j, action := range g.Actions {
+			if action != "pull" && action != "push" {
+				errs = append(errs, fmt.Sprintf("%s: actions[%d]: unknown action %q", where, j, action))
+			}
+		}
+	}
+	return errs
+}
+
+// identity is who a client authenticated as.
+type identity struct {
+	// subject identifies the client. It's empty for anonymous clients.
+	subject string
+
+	// grants are allowed by the client's credentials themselves, in
+	// addition to any configured for its subject.
+	grants []grant
+}
+
+// authenticator identifies clients from the credentials they send.
+type authenticator interface {
+	// authenticate returns the identity of the client sending r, and true,
+	// if r has credentials this authenticator recognizes, or an error if
+	// they're invalid.
+	authenticate(r *http.Request) (identity, bool, error)
+}
+
+// errInvalidCredentials is returned when no authenticator recognizes the
+// credentials a client sent.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// grant is a compiled Grant.
+type grant struct {
+	anonymous bool
+	subjects  []*regexp.Regexp
+	repos     []*regexp.Regexp
+	actions   map[string]bool
+}
+
+func newGrant(g Grant) grant {
+	cg := grant{anonymous: g.Anonymous, actions: map[string]bool{}}
+	for _, s := range g.Subjects {
+		re := "^" + strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, ".*") + "$"
+		cg.subjects = append(cg.subjects, regexp.MustCompile(re))
+	}
+	for _, r := range g.Repos {
+		cg.repos = append(cg.repos, regexp.MustCompile("^"+globToRegexp(r)+"$"))
+	}
+	actions := g.Actions
+	if len(actions) == 0 {
+		actions = []string{"pull"}
+	}
+	for _, a := range actions {
+		cg.actions[a] = true
+	}
+	return cg
+}
+
+func (g grant) appliesTo(id identity) bool {
+	if id.subject == "" {
+		return g.anonymous
+	}
+	for _, re := range g.subjects {
+		if re.MatchString(id.subject) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g grant) covers(repo string) bool {
+	for _, re := range g.repos {
+		if re.MatchString(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// issuer issues and verifies the redirector's own tokens.
+type issuer struct {
+	iss     string
+	service string
+	ttl     time.Duration
+	key     signingKey
+	keys    []publicKey
+
+	grants         []grant
+	authenticators []authenticator
+}
+
+// newIssuer loads the keys configured by a, which should already be valid.
+func newIssuer(a Auth) (*issuer, error) {
+	iss := &issuer{iss: a.Issuer, service: a.Service, ttl: defaultIssuedTokenTTL}
+	if iss.service == "" {
+		iss.service = a.Issuer
+	}
+	if a.TokenTTL != "" {
+		iss.ttl, _ = time.ParseDuration(a.TokenTTL)
+	}
+	for i, path := range a.SigningKeys {
+		k, err := loadSigningKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth: signingKeys[%d]: %w", i, err)
+		}
+		if i == 0 {
+			iss.key = k
+		}
+		pub, _ := newPublicKey(k.signer.Public())
+		iss.keys = append(iss.keys, pub)
+	}
+	for _, g := range a.Grants {
+		iss.grants = append(iss.grants, newGrant(g))
+	}
+	for i, o := range a.OIDC {
+		oa, err := newOIDCAuthenticator(o)
+		if err != nil {
+			return nil, fmt.Errorf("auth: oidc[%d]: %w", i, err)
+		}
+		iss.authenticators = append(iss.authenticators, oa)
+	}
+	if len(a.APIKeys) != 0 {
+		iss.authenticators = append(iss.authenticators, newAPIKeyAuthenticator(a.APIKeys))
+	}
+	return iss, nil
+}
+
+// access is a resource and the actions allowed on it, like the access claim
+// of tokens issued by the distribution token service.
+type access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// tokenClaims are the claims of the redirector's tokens.
+type tokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  string   `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expiry    int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	Access    []access `json:"access"`
+}
+
+// authenticate returns the identity of the client sending r, which is
+// anonymous if it sent no credentials.
+func (iss *issuer) authenticate(r *http.Request) (identity, error) {
+	for _, a := range iss.authenticators {
+		id, ok, err := a.authenticate(r)
+		if err != nil {
+			return identity{}, err
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	if r.Header.Get("Authorization") != "" {
+		return identity{}, errInvalidCredentials
+	}
+	return identity{}, nil
+}
+
+// allowed returns the actions id is granted on the repository name, out of
+// those requested, in the order requested.
+func (iss *issuer) allowed(id identity, name string, requested []string) []string {
+	allowed := []string{}
+	for _, action := range requested {
+		ok := false
+		for _, g := range iss.grants {
+			if g.actions[action] && g.appliesTo(id) && g.covers(name) {
+				ok = true
+				break
+			}
+		}
+		for _, g := range id.grants {
+			if g.actions[action] && g.covers(name) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			allowed = append(allowed, action)
+		}
+	}
+	return allowed
+}
+
+// issue returns a token for id, granting access.
+func (iss *issuer) issue(id identity, acc []access) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return signJWT(iss.key, tokenClaims{
+		Issuer:    iss.iss,
+		Subject:   id.subject,
+		Audience:  iss.service,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(iss.ttl).Unix(),
+		ID:        hex.EncodeToString(jti),
+		Access:    acc,
+	})
+}
+
+// verify returns the claims of a token issued by the redirector, if it's
+// valid now.
+func (iss *issuer) verify(token string) (*tokenClaims, error) {
+	var c tokenClaims
+	if err := verifyJWT(token, iss.keys, &c); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	switch {
+	case c.Issuer != iss.iss:
+		return nil, errors.New("token has the wrong issuer")
+	case c.Audience != iss.service:
+		return nil, errors.New("token has the wrong audience")
+	case now >= c.Expiry:
+		return nil, errors.New("token has expired")
+	case now < c.NotBefore:
+		return nil, errors.New("token isn't valid yet")
+	}
+	return &c, nil
+}
+
+// permits reports whether the claims allow action on the repository name.
+func (c tokenClaims) permits(name, action string) bool {
+	for _, a := range c.Access {
+		if a.Type != "repository" || a.Name != name {
+			continue
+		}
+		for _, act := range a.Actions {
+			if act == action || act == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// challenge returns the Www-Authenticate header telling clients to get a
+// token from the redirector at realm, for scope if it's set.
+func (iss *issuer) challenge(realm, scope, errCode string) string {
+	c := challenge{scheme: "Bearer"}
+	c.setParam("realm", realm)
+	c.setParam("service", iss.service)
+	if scope != "" {
+		c.setParam("scope", scope)
+	}
+	if errCode != "" {
+		c.setParam("error", errCode)
+	}
+	return c.String()
+}
+
+// requiredAction is the action a request with method needs on a repo.
+func requiredAction(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return "pull"
+	}
+	return "push"
+}
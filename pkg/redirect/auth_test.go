@@ -0,0 +1,237 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// writeKey writes a new PEM-encoded private key of the given type, "ec" or
+// "rsa", and returns its path.
+func writeKey(t *testing.T, typ string) string {
+	t.Helper()
+	var key interface{}
+	var err error
+	if typ == "rsa" {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), typ+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// getToken requests a token from the redirector for scope.
+func getToken(t *testing.T, reg, scope string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + reg + "/token?service=test&scope=" + scope)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("token: %s", resp.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		t.Fatalf("decoding token: %v", err)
+	}
+	if tr.Token == "" || tr.AccessToken != tr.Token || tr.ExpiresIn != 300 {
+		t.Errorf("got token response %+v", tr)
+	}
+	return tr.Token
+}
+
+// claims returns the unverified claims of a JWT.
+func claims(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %q", token)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c map[string]interface{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func headWithToken(t *testing.T, reg, repo, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodHead, "http://"+reg+"/v2/"+repo+"/manifests/main", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HEAD %s: %v", req.URL, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestIssuedTokens(t *testing.T) {
+	for _, typ := range []string{"ec", "rsa"} {
+		t.Run(typ, func(t *testing.T) {
+			up := newFakeUpstream(t)
+			want := up.push(t, "example/engine", "main")
+			up.push(t, "example/secret/engine", "main")
+
+			reg := newRedirector(t, redirect.Config{
+				Upstreams: []redirect.Upstream{up.upstream("fake")},
+				Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+				Auth: &redirect.Auth{
+					Issuer:      "https://registry.example.dev",
+					SigningKeys: []string{writeKey(t, typ), writeKey(t, "ec")},
+					Grants: []redirect.Grant{{
+						Anonymous: true,
+						Repos:     []string{"*"},
+					}},
+				},
+			})
+
+			// Anonymous clients can pull what they're granted, with tokens
+			// issued by the redirector.
+			got, err := crane.Digest(reg+"/engine:main", crane.WithTransport(forwardedHTTP{}))
+			if err != nil {
+				t.Fatalf("digest: %v", err)
+			}
+			if got != want {
+				t.Errorf("got digest %s, want %s", got, want)
+			}
+			if _, err := crane.Digest(reg+"/secret/engine:main", crane.WithTransport(forwardedHTTP{})); err == nil {
+				t.Error("digest of an ungranted repo: got nil error")
+			}
+
+			token := getToken(t, reg, "repository:engine:pull,push")
+			c := claims(t, token)
+			if c["iss"] != "https://registry.example.dev" || c["aud"] != "https://registry.example.dev" {
+				t.Errorf("got claims %v", c)
+			}
+			acc, _ := json.Marshal(c["access"])
+			if got, want := string(acc), `[{"actions":["pull"],"name":"engine","type":"repository"}]`; got != want {
+				t.Errorf("access: got %s, want %s", got, want)
+			}
+
+			// Every key is published.
+			resp, err := http.Get("http://" + reg + "/.well-known/jwks.json")
+			if err != nil {
+				t.Fatalf("jwks: %v", err)
+			}
+			defer resp.Body.Close()
+			var set struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+				t.Fatalf("decoding jwks: %v", err)
+			}
+			if len(set.Keys) != 2 {
+				t.Fatalf("got %d keys, want 2", len(set.Keys))
+			}
+			wantKty := map[string]string{"ec": "EC", "rsa": "RSA"}[typ]
+			if set.Keys[0]["kty"] != wantKty || set.Keys[0]["use"] != "sig" {
+				t.Errorf("got key %v", set.Keys[0])
+			}
+
+			for _, c := range []struct {
+				desc      string
+				repo      string
+				token     string
+				want      int
+				wantError string
+			}{
+				{"token", "engine", token, http.StatusOK, ""},
+				{"token for another repo", "secret/engine", token, http.StatusUnauthorized, "insufficient_scope"},
+				{"forged token", "engine", token[:strings.LastIndex(token, ".")] + ".AAAA", http.StatusUnauthorized, "invalid_token"},
+				{"upstream token", "engine", "fake-token-for-repository:example/engine:pull", http.StatusUnauthorized, "invalid_token"},
+				{"anonymous", "engine", "", http.StatusOK, ""},
+				{"anonymous, ungranted", "secret/engine", "", http.StatusUnauthorized, ""},
+			} {
+				t.Run(c.desc, func(t *testing.T) {
+					resp := headWithToken(t, reg, c.repo, c.token)
+					if resp.StatusCode != c.want {
+						t.Fatalf("got %s, want %d", resp.Status, c.want)
+					}
+					if c.want == http.StatusOK {
+						return
+					}
+					h := resp.Header.Get("Www-Authenticate")
+					if !strings.Contains(h, `realm="https://`+reg+`/token"`) || !strings.Contains(h, `scope="repository:`+c.repo+`:pull"`) {
+						t.Errorf("got challenge %q", h)
+					}
+					if !strings.Contains(h, `error="`+c.wantError+`"`) != (c.wantError == "") {
+						t.Errorf("got challenge %q, want error %q", h, c.wantError)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestAuthValidation(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		auth    redirect.Auth
+		wantErr string
+	}{
+		{"no issuer", redirect.Auth{SigningKeys: []string{"key.pem"}}, "issuer is required"},
+		{"no keys", redirect.Auth{Issuer: "https://example.dev"}, "at least one of signingKeys is required"},
+		{"bad ttl", redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, TokenTTL: "soon"}, `invalid duration "soon"`},
+		{"grant without subjects", redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, Grants: []redirect.Grant{{Repos: []string{"*"}}}}, "one of anonymous and subjects is required"},
+		{"subjects without authenticators", redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, Grants: []redirect.Grant{{Subjects: []string{"github:*"}, Repos: []string{"*"}}}}, "subjects require oidc or apiKeys"},
+		{"grant without repos", redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, Grants: []redirect.Grant{{Anonymous: true}}}, "at least one of repos is required"},
+		{"unknown action", redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, Grants: []redirect.Grant{{Anonymous: true, Repos: []string{"*"}, Actions: []string{"delete"}}}}, `unknown action "delete"`},
+		{"missing key", redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"/does/not/exist.pem"}}, "signingKeys[0]"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			auth := c.auth
+			_, err := redirect.NewFromConfig(redirect.Config{
+				Routes: []redirect.Route{{Repo: "example"}},
+				Auth:   &auth,
+			})
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
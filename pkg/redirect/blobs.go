@@ -0,0 +1,64 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+)
+
+// Blob policies, set by Route.Blobs.
+const (
+	blobRedirect = "redirect"
+	blobStream   = "stream"
+	blobReject   = "reject"
+)
+
+func validBlobPolicy(p string) bool {
+	switch p {
+	case "", blobRedirect, blobStream, blobReject:
+		return true
+	}
+	return false
+}
+
+// blobMetrics counts blob downloads by how they were served, and the bytes
+// streamed through the redirector. They're published at /debug/vars on the
+// admin server.
+var blobMetrics = expvar.NewMap("blobs")
+
+// blobPolicy returns how the route serves blob downloads.
+func (rt route) blobPolicy() string {
+	if rt.config.Blobs == "" {
+		return blobRedirect
+	}
+	return rt.config.Blobs
+}
+
+// isBlobRead reports whether r downloads a blob, or checks that it exists,
+// rather than uploading one.
+func isBlobRead(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	return len(parts) > 2 && parts[len(parts)-2] == "blobs" && parts[len(parts)-1] != "uploads"
+}
+
+// servesBlob reports whether resp is a blob's content, or part of it,
+// served directly by the upstream rather than redirected elsewhere.
+func servesBlob(r *http.Request, resp *http.Response) bool {
+	return r.Method == http.MethodGet && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent)
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
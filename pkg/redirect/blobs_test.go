@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+func bytesStreamed(t *testing.T) int64 {
+	t.Helper()
+	m, ok := expvar.Get("blobs").(*expvar.Map)
+	if !ok {
+		t.Fatal("blobs metrics aren't published")
+	}
+	if v, ok := m.Get("bytes_streamed").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestBlobs(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	d := "sha256:" + strings.Repeat("b", 64)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}
+	// An upstream that serves some blobs directly, and redirects to its
+	// storage for others, and doesn't require auth.
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+		case "/v2/example/direct/blobs/" + d, "/storage/" + d:
+			serve(w, r)
+		case "/v2/example/stored/blobs/" + d:
+			http.Redirect(w, r, "/storage/"+d, http.StatusTemporaryRedirect)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer up.Close()
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "blobs", URL: up.URL}},
+		Routes: []redirect.Route{
+			{Prefix: "redirect", Upstream: "blobs", Repo: "example"},
+			{Prefix: "stream", Upstream: "blobs", Repo: "example", Blobs: "stream"},
+			{Prefix: "reject", Upstream: "blobs", Repo: "example", Blobs: "reject"},
+		},
+	})
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, tc := range []struct {
+		desc       string
+		method     string
+		repo       string
+		rng        string
+		wantStatus int
+		wantBody   string
+		wantLoc    string
+	}{
+		{"redirect direct", http.MethodGet, "redirect/direct", "", http.StatusOK, string(content), ""},
+		{"redirect stored", http.MethodGet, "redirect/stored", "", http.StatusTemporaryRedirect, "", up.URL + "/storage/" + d},
+		{"redirect range", http.MethodGet, "redirect/direct", "bytes=4-7", http.StatusPartialContent, "4567", ""},
+		{"stream stored", http.MethodGet, "stream/stored", "", http.StatusOK, string(content), ""},
+		{"stream range", http.MethodGet, "stream/stored", "bytes=10-", http.StatusPartialContent, "abcdef", ""},
+		{"stream head", http.MethodHead, "stream/stored", "", http.StatusOK, "", ""},
+		{"reject direct", http.MethodGet, "reject/direct", "", http.StatusForbidden, "", ""},
+		{"reject head", http.MethodHead, "reject/direct", "", http.StatusOK, "", ""},
+		{"reject stored", http.MethodGet, "reject/stored", "", http.StatusTemporaryRedirect, "", up.URL + "/storage/" + d},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, "http://"+reg+"/v2/"+tc.repo+"/blobs/"+d, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.rng != "" {
+				req.Header.Set("Range", tc.rng)
+			}
+			before := bytesStreamed(t)
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusForbidden {
+				if !strings.Contains(string(body), "DENIED") {
+					t.Errorf("got body %q, want a DENIED error", body)
+				}
+				return
+			}
+			if tc.wantLoc == "" && string(body) != tc.wantBody {
+				t.Errorf("got body %q, want %q", body, tc.wantBody)
+			}
+			if got := resp.Header.Get("Location"); got != tc.wantLoc {
+				t.Errorf("got Location %q, want %q", got, tc.wantLoc)
+			}
+			// Streamed blobs' storage URLs are never revealed.
+			if got := resp.Header.Get("X-Redirected"); strings.Contains(got, "/storage/") {
+				t.Errorf("got X-Redirected %q, want the upstream's blob URL", got)
+			}
+			if got, want := bytesStreamed(t)-before, int64(len(tc.wantBody)); got != want {
+				t.Errorf("got %d bytes streamed, want %d", got, want)
+			}
+		})
+	}
+}
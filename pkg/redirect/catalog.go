@@ -0,0 +1,352 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// defaultCatalogPage is how many repos are listed per catalog page if
+	// the client doesn't ask for n, and maxCatalogPage is the most that
+	// are.
+	defaultCatalogPage = 100
+	maxCatalogPage     = 1000
+
+	// maxUpstreamCatalogPages is the most pages read from an upstream's
+	// catalog, so a misbehaving upstream can't keep a request going.
+	maxUpstreamCatalogPages = 100
+
+	// catalogTTL is how long upstream catalogs are cached, so clients
+	// listing repos don't multiply the load on upstreams.
+	catalogTTL = 30 * time.Second
+)
+
+// catalogCache caches upstream catalogs by upstream and credentials, like
+// tokenCache does tokens.
+type catalogCache struct {
+	mu       sync.Mutex
+	catalogs map[string]cachedCatalog
+	group    singleflight.Group
+}
+
+type cachedCatalog struct {
+	repos   []string
+	expires time.Time
+}
+
+var upstreamCatalogs = &catalogCache{catalogs: map[string]cachedCatalog{}}
+
+// get returns the cached catalog for key, or else calls list for it, and
+// caches it for catalogTTL. Concurrent misses for the same catalog share a
+// single call to list.
+func (c *catalogCache) get(key string, list func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	cc, ok := c.catalogs[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cc.expires) {
+		return cc.repos, nil
+	}
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		repos, err := list()
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		now := time.Now()
+		for k, cc := range c.catalogs {
+			if !now.Before(cc.expires) {
+				delete(c.catalogs, k)
+			}
+		}
+		c.catalogs[key] = cachedCatalog{repos: repos, expires: now.Add(catalogTTL)}
+		return repos, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]string), nil
+}
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+// catalog serves /v2/_catalog, listing the user-visible repos of every route
+// on the host that the client is allowed to pull, paginated with n and last
+// as described by the distribution spec.
+func (rdr redirect) catalog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	n := defaultCatalogPage
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			registryError(w, http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", fmt.Sprintf("invalid n %q", v))
+			return
+		}
+		if n > maxCatalogPage {
+			n = maxCatalogPage
+		}
+	}
+	last := r.URL.Query().Get("last")
+
+	visible, err := rdr.pullable(r)
+	if err != nil {
+		logger.Infow("denied catalog request", "error", err)
+		registryError(w, http.StatusForbidden, "DENIED", err.Error())
+		return
+	}
+
+	seen := map[string]bool{}
+	var repos []string
+	for _, rt := range rdr.routes {
+		names, err := rdr.routeCatalog(r, rt)
+		if err != nil {
+			// The rest of the catalog is still useful.
+			logger.Warnw("listing route's repos failed, skipping it",
+				"prefix", rt.prefix,
+				"error", err)
+			continue
+		}
+		for _, name := range names {
+			if !seen[name] && visible(name) {
+				seen[name] = true
+				repos = append(repos, name)
+			}
+		}
+	}
+	sort.Strings(repos)
+
+	i := sort.SearchStrings(repos, last)
+	if i < len(repos) && repos[i] == last {
+		i++
+	}
+	page := repos[i:]
+	if n == 0 {
+		page = nil
+	} else if len(page) > n {
+		page = page[:n]
+		q := url.Values{"n": {strconv.Itoa(n)}, "last": {page[len(page)-1]}}
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?%s>; rel="next"`, q.Encode()))
+	}
+	if page == nil {
+		page = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalogResponse{Repositories: page}) //nolint:errcheck
+}
+
+// pullable returns whether the client sending r may pull each user-visible
+// repo name, as allowed by its certificate and by the redirector's tokens or
+// grants, if they're configured.
+func (rdr redirect) pullable(r *http.Request) (func(string) bool, error) {
+	allowed := []func(string) bool{}
+	if rdr.certs != nil {
+		c, err := clientCert(r)
+		if err != nil {
+			return nil, err
+		}
+		allowed = append(allowed, func(name string) bool {
+			return len(rdr.certs.allowed(c, name, []string{"pull"})) > 0
+		})
+	}
+	if rdr.issuer != nil {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			c, err := rdr.issuer.verify(token)
+			if err != nil {
+				return nil, err
+			}
+			allowed = append(allowed, func(name string) bool { return c.permits(name, "pull") })
+		} else {
+			id, err := rdr.issuer.authenticate(r)
+			if err != nil {
+				return nil, err
+			}
+			allowed = append(allowed, func(name string) bool {
+				return len(rdr.issuer.allowed(id, name, []string{"pull"})) > 0
+			})
+		}
+	}
+	return func(name string) bool {
+		for _, ok := range allowed {
+			if !ok(name) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// routeCatalog returns the user-visible names of rt's repos, as configured,
+// or else from its upstream's catalog.
+func (rdr redirect) routeCatalog(r *http.Request, rt route) ([]string, error) {
+	if len(rt.config.Catalog) != 0 {
+		var names []string
+		for _, name := range rt.config.Catalog {
+			if rt.prefix != "" {
+				name = rt.prefix + "/" + name
+			}
+			names = append(names, name)
+		}
+		return names, nil
+	}
+
+	var err error
+	for _, up := range rt.upstreams {
+		var upstreamRepos []string
+		if upstreamRepos, err = rdr.upstreamCatalog(r, rt, up); err != nil {
+			continue
+		}
+		var names []string
+		for _, ur := range upstreamRepos {
+			if name, ok := rdr.catalogName(rt, up, ur); ok {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	return nil, err
+}
+
+// catalogName returns the user-visible name of the upstream repo ur on up,
+// if it's served by rt. Only names rt maps back to ur are listed, so renamed
+// repos aren't listed under their upstream names.
+func (rdr redirect) catalogName(rt route, up *upstream, ur string) (string, bool) {
+	rest := ur
+	if rt.repo != "" {
+		if !strings.HasPrefix(ur, rt.repo+"/") {
+			return "", false
+		}
+		rest = strings.TrimPrefix(ur, rt.repo+"/")
+	}
+	if short := strings.TrimPrefix(rest, "library/"); up.Library && !strings.Contains(short, "/") {
+		rest = short
+	}
+	name := rest
+	if rt.prefix != "" {
+		name = rt.prefix + "/" + rest
+	}
+	if rt.upstreamName(up, name) != ur {
+		return "", false
+	}
+	if m, ok := rdr.match(name); !ok || m.prefix != rt.prefix {
+		return "", false
+	}
+	return name, true
+}
+
+// nextLink matches the URL of a Link header's next page.
+var nextLink = regexp.MustCompile(`^<([^>]+)>;\s*rel="?next"?`)
+
+// upstreamCatalog returns every repo in the catalog of up, one of rt's
+// upstreams, requesting it with the client's credentials, or else the
+// upstream credentials for clients that don't send any. Catalogs are cached
+// for clients with the same credentials.
+func (rdr redirect) upstreamCatalog(r *http.Request, rt route, up *upstream) ([]string, error) {
+	auth := r.Header.Get("Authorization")
+	if up != rt.primary || rdr.issuer != nil {
+		// Credentials are for the primary upstream, and the redirector's
+		// own tokens are never sent upstream.
+		auth = ""
+	}
+	if auth == "" {
+		creds, err := rdr.credentials(rt, up)
+		if err != nil {
+			return nil, err
+		}
+		auth = creds
+	}
+	return upstreamCatalogs.get(tokenKey(up, "registry:catalog:*", auth), func() ([]string, error) {
+		return rdr.listUpstreamCatalog(r, up, auth)
+	})
+}
+
+// listUpstreamCatalog reads every page of the catalog of up, with auth, which
+// is exchanged for a token if it's Basic credentials or an identity token.
+// The listing isn't canceled with r, since it's shared with other clients.
+func (rdr redirect) listUpstreamCatalog(r *http.Request, up *upstream, auth string) ([]string, error) {
+	logger := logging.FromContext(r.Context())
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	if _, identity := identityToken(auth); auth == "" || isBasic(auth) || identity {
+		t, _, err := rdr.getToken(r.WithContext(ctx), up, "registry:catalog:*", auth)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case t != "":
+			auth = "Bearer " + t
+		case identity:
+			// Identity tokens are never sent as they are.
+			auth = ""
+		}
+	}
+
+	base, err := url.Parse(up.URL)
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	next := up.v2URL("_catalog") + "?n=" + strconv.Itoa(maxCatalogPage)
+	for page := 0; next != "" && page < maxUpstreamCatalogPages; page++ {
+		req, err := up.newRequest(http.MethodGet, next, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		logger.Infow("sending request",
+			"method", req.Method,
+			"url", req.URL.String(),
+			"upstream", up.Name,
+			"header", redact(req.Header))
+		resp, err := client.Do(req.WithContext(ctx)) //nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+		var cr catalogResponse
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&cr)
+		} else {
+			err = statusError{resp.StatusCode, resp.Status}
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, cr.Repositories...)
+
+		next = ""
+		if m := nextLink.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			u, err := base.Parse(m[1])
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		}
+	}
+	return repos, nil
+}
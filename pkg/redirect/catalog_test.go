@@ -0,0 +1,151 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+// getCatalog gets a catalog page from the redirector at reg, returning the
+// status, the repos and the Link header.
+func getCatalog(t *testing.T, reg, query string) (int, []string, string) {
+	t.Helper()
+	u := "http://" + reg + "/v2/_catalog"
+	if query != "" {
+		u += "?" + query
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("catalog: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Repositories []string `json:"repositories"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decoding catalog: %v", err)
+		}
+	}
+	return resp.StatusCode, body.Repositories, resp.Header.Get("Link")
+}
+
+func TestCatalog(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.push(t, "example/engine", "main")
+	up.push(t, "example/cli", "main")
+	up.push(t, "private/secret", "main")
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes: []redirect.Route{
+			{Prefix: "unicorns", Upstream: "fake", Repo: "example"},
+			{Prefix: "static", Upstream: "fake", Repo: "elsewhere", Catalog: []string{"a", "b/c"}},
+		},
+	})
+
+	for _, c := range []struct {
+		desc      string
+		query     string
+		want      int
+		wantRepos string
+		wantLink  string
+	}{
+		{"all", "", http.StatusOK, "static/a,static/b/c,unicorns/cli,unicorns/engine", ""},
+		{"first page", "n=2", http.StatusOK, "static/a,static/b/c", `</v2/_catalog?last=static%2Fb%2Fc&n=2>; rel="next"`},
+		{"last page", "n=2&last=static/b/c", http.StatusOK, "unicorns/cli,unicorns/engine", ""},
+		{"after a missing repo", "n=1&last=unicorns/bar", http.StatusOK, "unicorns/cli", `</v2/_catalog?last=unicorns%2Fcli&n=1>; rel="next"`},
+		{"past the end", "last=unicorns/engine", http.StatusOK, "", ""},
+		{"empty page", "n=0", http.StatusOK, "", ""},
+		{"invalid n", "n=lots", http.StatusBadRequest, "", ""},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			status, repos, link := getCatalog(t, reg, c.query)
+			if status != c.want {
+				t.Fatalf("got status %d, want %d", status, c.want)
+			}
+			if got := strings.Join(repos, ","); got != c.wantRepos {
+				t.Errorf("got repos %q, want %q", got, c.wantRepos)
+			}
+			if link != c.wantLink {
+				t.Errorf("got Link %q, want %q", link, c.wantLink)
+			}
+		})
+	}
+}
+
+func TestUpstreamCatalog(t *testing.T) {
+	// An upstream with a paginated catalog, which doesn't require auth.
+	pages := map[string]string{
+		"":          `{"repositories":["example/engine","example/old-cli","library/nginx"]}`,
+		"example/z": `{"repositories":["library/foo/bar","other/engine"]}`,
+		"library/z": `{"repositories":[]}`,
+	}
+	var listings int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			return
+		}
+		switch last := r.URL.Query().Get("last"); last {
+		case "":
+			atomic.AddInt32(&listings, 1)
+			w.Header().Set("Link", `</v2/_catalog?last=example/z&n=3>; rel="next"`)
+		case "example/z":
+			w.Header().Set("Link", `<`+"http://"+r.Host+`/v2/_catalog?last=library/z&n=3>; rel="next"`)
+		}
+		w.Write([]byte(pages[r.URL.Query().Get("last")])) //nolint:errcheck
+	}))
+	defer up.Close()
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "oci", URL: up.URL}, {Name: "hub", URL: up.URL, Library: true}},
+		Routes: []redirect.Route{
+			{Prefix: "unicorns", Upstream: "oci", Repo: "example", Renames: []redirect.Rename{{Glob: "cli", Replace: "old-cli"}}},
+			{Prefix: "hub", Upstream: "hub"},
+		},
+	})
+	_, repos, _ := getCatalog(t, reg, "")
+	// Repos are listed by the names that map back to them, which doesn't
+	// include names renamed to them, like unicorns/cli.
+	want := "hub/example/engine,hub/example/old-cli,hub/library/foo/bar,hub/nginx,hub/other/engine,unicorns/engine,unicorns/old-cli"
+	if got := strings.Join(repos, ","); got != want {
+		t.Errorf("got repos %q, want %q", got, want)
+	}
+
+	// Each upstream's catalog is only listed once for a while.
+	getCatalog(t, reg, "")
+	if got := atomic.LoadInt32(&listings); got != 2 {
+		t.Errorf("got %d upstream listings, want 2", got)
+	}
+}
+
+func TestCatalogAuth(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.push(t, "example/engine", "main")
+	up.push(t, "example/secret", "main")
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+		Auth: &redirect.Auth{
+			Issuer:      "https://registry.example.dev",
+			SigningKeys: []string{writeKey(t, "ec")},
+			Grants:      []redirect.Grant{{Anonymous: true, Repos: []string{"engine"}}},
+		},
+	})
+	// Clients only see the repos they can pull.
+	_, repos, _ := getCatalog(t, reg, "")
+	if got := strings.Join(repos, ","); got != "engine" {
+		t.Errorf("got repos %q, want engine", got)
+	}
+}
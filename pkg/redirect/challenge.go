@@ -0,0 +1,362 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// challenge is a single authentication challenge from a Www-Authenticate
+// header, as described by RFC 7235.
+type challenge struct {
+	scheme string
+	// token68 is set for challenges like `Negotiate abc==`, in place of params.
+	token68 string
+	params  []authParam
+}
+
+type authParam struct {
+	name, value string
+}
+
+// param returns the value of the named parameter, case-insensitively.
+func (c challenge) param(name string) string {
+	for _, p := range c.params {
+		if strings.EqualFold(p.name, name) {
+			return p.value
+		}
+	}
+	return ""
+}
+
+// setParam replaces the value of the named parameter, or adds it.
+func (c *challenge) setParam(name, value string) {
+	for i, p := range c.params {
+		if strings.EqualFold(p.name, name) {
+			c.params[i].value = value
+			return
+		}
+	}
+	c.params = append(c.params, authParam{name, value})
+}
+
+// delParam removes the named parameter, if it's set.
+func (c *challenge) delParam(name string) {
+	for i, p := range c.params {
+		if strings.EqualFold(p.name, name) {
+			c.params = append(c.params[:i], c.params[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c challenge) String() string {
+	if c.token68 != "" {
+		return c.scheme + " " + c.token68
+	}
+	ps := make([]string, 0, len(c.params))
+	for _, p := range c.params {
+		ps = append(ps, p.name+"="+quote(p.value))
+	}
+	if len(ps) == 0 {
+		return c.scheme
+	}
+	return c.scheme + " " + strings.Join(ps, ",")
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// parseChallenges parses every challenge in a Www-Authenticate header value.
+func parseChallenges(h string) ([]challenge, error) {
+	p := challengeParser{s: h}
+	var cs []challenge
+	for {
+		p.skipListSeparators()
+		if p.done() {
+			break
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, fmt.Errorf("expected auth-scheme at %d in %q", p.i, h)
+		}
+		c := challenge{scheme: scheme}
+		p.skipSpace()
+		// A token68, like `abc==`, is all that follows its auth-scheme, up
+		// to the next challenge. Anything else, like `realm="x"` or
+		// `realm = x`, is parameters.
+		start := p.i
+		if t := p.token68(); t != "" {
+			p.skipSpace()
+			if p.done() || p.peek() == ',' {
+				c.token68 = t
+				cs = append(cs, c)
+				continue
+			}
+			p.i = start
+		}
+		// Parameters continue until the next auth-scheme, which is a token
+		// that isn't followed by "=".
+		for !p.done() {
+			start := p.i
+			name := p.token()
+			p.skipSpace()
+			if name == "" || p.peek() != '=' {
+				p.i = start
+				break
+			}
+			p.i++
+			p.skipSpace()
+			var value string
+			if p.peek() == '"' {
+				var err error
+				if value, err = p.quotedString(); err != nil {
+					return nil, fmt.Errorf("%w in %q", err, h)
+				}
+			} else {
+				value = p.token()
+			}
+			c.params = append(c.params, authParam{name, value})
+			p.skipSpace()
+			if p.peek() != ',' {
+				break
+			}
+			p.skipListSeparators()
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+type challengeParser struct {
+	s string
+	i int
+}
+
+func (p *challengeParser) done() bool { return p.i >= len(p.s) }
+
+func (p *challengeParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *challengeParser) skipSpace() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *challengeParser) skipListSeparators() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == ',') {
+		p.i++
+	}
+}
+
+// isTokenChar reports whether c is a tchar, from RFC 7230.
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func (p *challengeParser) token() string {
+	start := p.i
+	for !p.done() && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *challengeParser) token68() string {
+	start := p.i
+	for !p.done() && (isTokenChar(p.s[p.i]) || p.s[p.i] == '/') {
+		p.i++
+	}
+	for !p.done() && p.s[p.i] == '=' {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *challengeParser) quotedString() (string, error) {
+	p.i++ // opening quote
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.done() {
+				return "", errors.New("unterminated quoted-string")
+			}
+			b.WriteByte(p.s[p.i])
+			p.i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted-string")
+}
+
+// tokenService describes where an upstream issues bearer tokens.
+type tokenService struct {
+	realm   string
+	service string
+
+	// anonymous is true if the upstream doesn't issue tokens, because it
+	// doesn't require any auth, or only challenges clients for Basic
+	// credentials, which are sent to it as they are.
+	anonymous bool
+}
+
+// url returns the URL to request a token with the given query.
+func (ts tokenService) url(query url.Values) string {
+	if len(query) == 0 {
+		return ts.realm
+	}
+	sep := "?"
+	if strings.Contains(ts.realm, "?") {
+		sep = "&"
+	}
+	return ts.realm + sep + query.Encode()
+}
+
+// discoveryTTL is how long a discovered token service is used before it's
+// discovered again.
+const discoveryTTL = time.Hour
+
+// tokenService returns the upstream's token service, as configured, or as
+// discovered from the challenge to an anonymous request for /v2/. Upstreams
+// without a Bearer challenge have none.
+func (u *upstream) tokenService(ctx context.Context) (tokenService, error) {
+	if u.TokenURL != "" {
+		return tokenService{realm: u.TokenURL, service: u.Service}, nil
+	}
+
+	u.mu.Lock()
+	ts, at := u.discovered, u.discoveredAt
+	u.mu.Unlock()
+	if !at.IsZero() && time.Since(at) < discoveryTTL {
+		return ts, nil
+	}
+
+	req, err := u.newRequest(http.MethodGet, u.v2URL(""), nil, nil)
+	if err != nil {
+		return tokenService{}, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return tokenService{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ts = tokenService{anonymous: true}
+	case http.StatusUnauthorized:
+		var ok bool
+		if ts, ok = u.learn(resp.Header.Values("Www-Authenticate")); ok {
+			return ts, nil
+		}
+		// Registries that only take Basic credentials, like those behind
+		// htpasswd, challenge clients themselves.
+		ts = tokenService{anonymous: true}
+	default:
+		return tokenService{}, fmt.Errorf("unexpected status discovering token service at %s: %s", u.v2URL(""), resp.Status)
+	}
+	u.remember(ts)
+	return ts, nil
+}
+
+// learn remembers the token service from the upstream's Bearer challenge,
+// if any.
+func (u *upstream) learn(hs []string) (tokenService, bool) {
+	for _, h := range hs {
+		cs, err := parseChallenges(h)
+		if err != nil {
+			continue
+		}
+		for _, c := range cs {
+			if strings.EqualFold(c.scheme, "Bearer") && c.param("realm") != "" {
+				ts := tokenService{realm: c.param("realm"), service: c.param("service")}
+				u.remember(ts)
+				return ts, true
+			}
+		}
+	}
+	return tokenService{}, false
+}
+
+func (u *upstream) remember(ts tokenService) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.discovered, u.discoveredAt = ts, time.Now()
+}
+
+// rewriteChallenge rewrites the realm of any Bearer challenge in the
+// upstream's Www-Authenticate header to point at the redirector's /token.
+func rewriteChallenge(h, realm string) string {
+	cs, err := parseChallenges(h)
+	if err != nil {
+		return h
+	}
+	out := make([]string, 0, len(cs))
+	for _, c := range cs {
+		if strings.EqualFold(c.scheme, "Bearer") && c.param("realm") != "" {
+			c.setParam("realm", realm)
+		}
+		out = append(out, c.String())
+	}
+	return strings.Join(out, ", ")
+}
+
+// rewriteChallengeScope renames the repos in the scope of any Bearer
+// challenge in the upstream's Www-Authenticate header from their upstream
+// names to the names clients know them by, as returned by userName, so
+// clients request tokens for the repos they asked for. Repos userName can't
+// rename are dropped from the scope.
+func rewriteChallengeScope(h string, userName func(string) (string, bool)) string {
+	cs, err := parseChallenges(h)
+	if err != nil {
+		return h
+	}
+	out := make([]string, 0, len(cs))
+	for _, c := range cs {
+		if strings.EqualFold(c.scheme, "Bearer") && c.param("scope") != "" {
+			if scopes, err := parseScopes([]string{c.param("scope")}); err == nil {
+				ss := make([]string, 0, len(scopes))
+				for _, s := range scopes {
+					if s.typ == "repository" {
+						var ok bool
+						if s.name, ok = userName(s.name); !ok {
+							continue
+						}
+					}
+					ss = append(ss, s.String())
+				}
+				if len(ss) == 0 {
+					c.delParam("scope")
+				} else {
+					c.setParam("scope", strings.Join(ss, " "))
+				}
+			}
+		}
+		out = append(out, c.String())
+	}
+	return strings.Join(out, ", ")
+}
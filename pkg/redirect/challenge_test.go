@@ -0,0 +1,152 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	bearer := challenge{scheme: "Bearer", params: []authParam{{"realm", "https://auth.example/token"}, {"service", "example"}}}
+	for _, c := range []struct {
+		desc    string
+		h       string
+		want    []challenge
+		wantErr bool
+	}{
+		{"bearer", `Bearer realm="https://auth.example/token",service="example"`, []challenge{bearer}, false},
+		{"token value", `Bearer realm="https://auth.example/token",service=example`, []challenge{bearer}, false},
+		{"whitespace around =", `Bearer realm = "https://auth.example/token", service = "example"`, []challenge{bearer}, false},
+		{"whitespace after =", `Bearer realm= "https://auth.example/token",service= example`, []challenge{bearer}, false},
+		{"empty list elements", `Bearer realm="https://auth.example/token",, service="example"`, []challenge{bearer}, false},
+		{"several challenges", `Basic realm="basic", Bearer realm="https://auth.example/token",service="example"`, []challenge{
+			{scheme: "Basic", params: []authParam{{"realm", "basic"}}},
+			bearer,
+		}, false},
+		{"scheme only", `Basic, Bearer realm="https://auth.example/token",service="example"`, []challenge{
+			{scheme: "Basic"},
+			bearer,
+		}, false},
+		{"token68", `Negotiate abc==, Bearer realm="https://auth.example/token",service="example"`, []challenge{
+			{scheme: "Negotiate", token68: "abc=="},
+			bearer,
+		}, false},
+		{"token68 with slashes", `Negotiate a/b+c=`, []challenge{{scheme: "Negotiate", token68: "a/b+c="}}, false},
+		{"token68 without padding", `Negotiate abc`, []challenge{{scheme: "Negotiate", token68: "abc"}}, false},
+		{"escaped quotes", `Bearer realm="https://auth.example/token",error_description="say \"hi\" \\ then"`, []challenge{
+			{scheme: "Bearer", params: []authParam{{"realm", "https://auth.example/token"}, {"error_description", `say "hi" \ then`}}},
+		}, false},
+		{"unterminated quoted-string", `Bearer realm="https://auth.example/token`, nil, true},
+		{"no scheme", `="x"`, nil, true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := parseChallenges(c.h)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("parseChallenges(%q): got error %v, want error %t", c.h, err, c.wantErr)
+			}
+			if c.want != nil && !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseChallenges(%q):\ngot  %+v\nwant %+v", c.h, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRewriteChallenge(t *testing.T) {
+	const realm = "https://registry.example.dev/token"
+	for _, c := range []struct {
+		desc string
+		h    string
+		want string
+	}{
+		{"bearer", `Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:a/b:pull"`,
+			`Bearer realm="https://registry.example.dev/token",service="ghcr.io",scope="repository:a/b:pull"`},
+		{"whitespace around =", `Bearer realm = "https://ghcr.io/token", service = "ghcr.io"`,
+			`Bearer realm="https://registry.example.dev/token",service="ghcr.io"`},
+		{"other schemes", `Basic realm="basic", Negotiate abc==, Bearer realm="https://ghcr.io/token"`,
+			`Basic realm="basic", Negotiate abc==, Bearer realm="https://registry.example.dev/token"`},
+		{"bearer without realm", `Bearer error="invalid_token"`, `Bearer error="invalid_token"`},
+		{"unparseable", `Bearer realm="https://ghcr.io/token`, `Bearer realm="https://ghcr.io/token`},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			if got := rewriteChallenge(c.h, realm); got != c.want {
+				t.Errorf("rewriteChallenge(%q):\ngot  %s\nwant %s", c.h, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRewriteChallengeScope(t *testing.T) {
+	names := map[string]string{
+		"example/engine": "unicorns/engine",
+		"example/base":   "unicorns/base",
+	}
+	userName := func(ur string) (string, bool) {
+		name, ok := names[ur]
+		return name, ok
+	}
+	for _, c := range []struct {
+		desc string
+		h    string
+		want string
+	}{
+		{"repo", `Bearer realm="r",scope="repository:example/engine:pull,push"`,
+			`Bearer realm="r",scope="repository:unicorns/engine:pull,push"`},
+		{"several scopes", `Bearer realm="r",scope="repository:example/base:pull repository:example/engine:pull"`,
+			`Bearer realm="r",scope="repository:unicorns/base:pull repository:unicorns/engine:pull"`},
+		{"unknown repo", `Bearer realm="r",scope="repository:elsewhere/base:pull repository:example/engine:pull,push"`,
+			`Bearer realm="r",scope="repository:unicorns/engine:pull,push"`},
+		{"only unknown repos", `Bearer realm="r",scope="repository:elsewhere/base:pull",service="s"`, `Bearer realm="r",service="s"`},
+		{"other resources", `Bearer realm="r",scope="registry:catalog:*"`, `Bearer realm="r",scope="registry:catalog:*"`},
+		{"no scope", `Bearer realm="r"`, `Bearer realm="r"`},
+		{"malformed scope", `Bearer realm="r",scope="nope"`, `Bearer realm="r",scope="nope"`},
+		{"unparseable", `Bearer scope="repository:example/engine:pull`, `Bearer scope="repository:example/engine:pull`},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			if got := rewriteChallengeScope(c.h, userName); got != c.want {
+				t.Errorf("rewriteChallengeScope(%q):\ngot  %s\nwant %s", c.h, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTokenService(t *testing.T) {
+	for _, c := range []struct {
+		desc      string
+		status    int
+		challenge string
+		want      tokenService
+		wantErr   bool
+	}{
+		{"anonymous", http.StatusOK, "", tokenService{anonymous: true}, false},
+		{"bearer", http.StatusUnauthorized, `Bearer realm="https://auth.example/token",service="example"`, tokenService{realm: "https://auth.example/token", service: "example"}, false},
+		{"bearer after basic", http.StatusUnauthorized, `Basic realm="registry", Bearer realm="https://auth.example/token"`, tokenService{realm: "https://auth.example/token"}, false},
+		{"basic only", http.StatusUnauthorized, `Basic realm="registry"`, tokenService{anonymous: true}, false},
+		{"no challenge", http.StatusUnauthorized, "", tokenService{anonymous: true}, false},
+		{"error", http.StatusInternalServerError, "", tokenService{}, true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if c.challenge != "" {
+					w.Header().Set("Www-Authenticate", c.challenge)
+				}
+				w.WriteHeader(c.status)
+			}))
+			defer s.Close()
+			up := newUpstream(Upstream{Name: "test", URL: s.URL})
+			got, err := up.tokenService(context.Background())
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %t", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"knative.dev/pkg/logging"
+)
+
+// ClientCert allows clients presenting a verified TLS client certificate
+// with a matching name to take actions on some repos, so nodes can pull
+// without registry passwords. Certificates are verified by the server, as
+// configured by the -client-ca flag.
+type ClientCert struct {
+	// Names are globs, where * matches anything, matching the certificate's
+	// subject common name, or any of its DNS, email, IP or URI SANs.
+	Names []string `json:"names"`
+
+	// Repos are globs matching the user-visible repo names access is
+	// granted to, like in Grant.
+	Repos []string `json:"repos"`
+
+	// Actions are the actions allowed, "pull" or "push". Defaults to pull.
+	Actions []string `json:"actions,omitempty"`
+}
+
+// validate reports the problems with the client certificate configuration.
+func (c ClientCert) validate() []string {
+	var errs []string
+	if len(c.Names) == 0 {
+		errs = append(errs, "at least one of names is required")
+	}
+	if len(c.Repos) == 0 {
+		errs = append(errs, "at least one of repos is required")
+	}
+	for i, action := range c.Actions {
+		if action != "pull" && action != "push" {
+			errs = append(errs, fmt.Sprintf("actions[%d]: unknown action %q", i, action))
+		}
+	}
+	return errs
+}
+
+// certPolicy authorizes clients by their certificates. It's nil if clients
+// aren't authorized by certificate.
+type certPolicy []grant
+
+func newCertPolicy(certs []ClientCert) certPolicy {
+	var p certPolicy
+	for _, c := range certs {
+		p = append(p, newGrant(Grant{Subjects: c.Names, Repos: c.Repos, Actions: c.Actions}))
+	}
+	return p
+}
+
+// errNoClientCert is returned for requests without a verified client
+// certificate.
+var errNoClientCert = errors.New("a verified client certificate is required")
+
+// clientCert returns the verified client certificate of r.
+func clientCert(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errNoClientCert
+	}
+	return r.TLS.VerifiedChains[0][0], nil
+}
+
+// certNames returns every name a certificate identifies its holder by.
+func certNames(c *x509.Certificate) []string {
+	var names []string
+	if c.Subject.CommonName != "" {
+		names = append(names, c.Subject.CommonName)
+	}
+	names = append(names, c.DNSNames...)
+	names = append(names, c.EmailAddresses...)
+	for _, ip := range c.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range c.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// allowed returns the requested actions the holder of c is allowed to take
+// on the repo name.
+func (p certPolicy) allowed(c *x509.Certificate, name string, requested []string) []string {
+	names := certNames(c)
+	allowed := []string{}
+	for _, action := range requested {
+		ok := false
+		for _, g := range p {
+			if !g.actions[action] || !g.covers(name) {
+				continue
+			}
+			for _, n := range names {
+				if g.appliesTo(identity{subject: n}) {
+					ok = true
+					break
+				}
+			}
+			if ok {
+				break
+			}
+		}
+		if ok {
+			allowed = append(allowed, action)
+		}
+	}
+	return allowed
+}
+
+// authorizeCert checks that the client's certificate allows the action r
+// needs on the repo name. Otherwise, it responds with an error and returns
+// false.
+func (rdr redirect) authorizeCert(w http.ResponseWriter, r *http.Request, name string) bool {
+	logger := logging.FromContext(r.Context())
+	action := requiredAction(r.Method)
+	c, err := clientCert(r)
+	if err != nil {
+		logger.Infow("denied request without a client certificate", "repo", name, "action", action)
+		registryError(w, http.StatusForbidden, "DENIED", err.Error())
+		return false
+	}
+	if len(rdr.certs.allowed(c, name, []string{action})) == 0 {
+		logger.Infow("denied request by client certificate",
+			"subject", c.Subject.String(),
+			"repo", name,
+			"action", action)
+		registryError(w, http.StatusForbidden, "DENIED", fmt.Sprintf("certificate doesn't allow %s on %s", action, name))
+		return false
+	}
+	logger.Infow("allowed request by client certificate",
+		"subject", c.Subject.String(),
+		"repo", name,
+		"action", action)
+	return true
+}
+
+// certScopes returns the scopes of a token request restricted to the actions
+// the client's certificate allows, dropping repository scopes it allows
+// nothing on. If it allows nothing that was requested, it responds with an
+// error and returns false.
+func (rdr redirect) certScopes(w http.ResponseWriter, r *http.Request, scopes []scope) ([]scope, bool) {
+	logger := logging.FromContext(r.Context())
+	c, err := clientCert(r)
+	if err != nil {
+		logger.Infow("denied token request without a client certificate")
+		registryError(w, http.StatusForbidden, "DENIED", err.Error())
+		return nil, false
+	}
+	var kept []scope
+	repos, allowed := 0, 0
+	for _, s := range scopes {
+		if s.typ != "repository" {
+			kept = append(kept, s)
+			continue
+		}
+		repos++
+		actions := rdr.certs.allowed(c, s.name, s.actions)
+		logger.Infow("authorized token scope by client certificate",
+			"subject", c.Subject.String(),
+			"repo", s.name,
+			"requested", s.actions,
+			"allowed", actions)
+		if len(actions) == 0 {
+			continue
+		}
+		s.actions = actions
+		kept = append(kept, s)
+		allowed++
+	}
+	if repos > 0 && allowed == 0 {
+		registryError(w, http.StatusForbidden, "DENIED", "certificate doesn't allow any requested scope")
+		return nil, false
+	}
+	return kept, true
+}
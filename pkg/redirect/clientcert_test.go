@@ -0,0 +1,198 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+// testCA issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate for cn and uris.
+func (ca *testCA) issue(t *testing.T, cn string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, u := range uris {
+		pu, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, pu)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCerts(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.push(t, "example/engine", "main")
+	up.push(t, "example/secret", "main")
+
+	h, err := redirect.NewFromConfig(redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+		ClientCerts: []redirect.ClientCert{{
+			Names: []string{"node-*.internal"},
+			Repos: []string{"engine"},
+		}, {
+			Names:   []string{"spiffe://cluster/ns/ci/*"},
+			Repos:   []string{"**"},
+			Actions: []string{"pull", "push"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig: %v", err)
+	}
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	s := httptest.NewUnstartedServer(h)
+	// Requests without certificates get to the redirector, so it can be
+	// seen denying them.
+	s.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	s.StartTLS()
+	defer s.Close()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		c := *s.Client()
+		tr := c.Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = certs
+		c.Transport = tr
+		return &c
+	}
+	node := client(ca.issue(t, "node-1.internal"))
+	ci := client(ca.issue(t, "builder", "spiffe://cluster/ns/ci/sa/builder"))
+	other := client(ca.issue(t, "laptop.example"))
+	untrusted := client(newTestCA(t).issue(t, "node-1.internal"))
+	anonymous := client()
+
+	for _, c := range []struct {
+		desc   string
+		client *http.Client
+		method string
+		path   string
+		want   int
+	}{
+		{"allowed repo", node, http.MethodHead, "/v2/engine/manifests/main", http.StatusOK},
+		{"other repo", node, http.MethodHead, "/v2/secret/manifests/main", http.StatusForbidden},
+		{"push", node, http.MethodPut, "/v2/engine/manifests/main", http.StatusForbidden},
+		{"URI SAN", ci, http.MethodHead, "/v2/secret/manifests/main", http.StatusOK},
+		{"unknown name", other, http.MethodHead, "/v2/engine/manifests/main", http.StatusForbidden},
+		{"no certificate", anonymous, http.MethodHead, "/v2/engine/manifests/main", http.StatusForbidden},
+		{"untrusted certificate", untrusted, http.MethodHead, "/v2/engine/manifests/main", 0},
+		{"token", node, http.MethodGet, "/token?scope=repository:engine:pull,push", http.StatusOK},
+		{"token for other repo", node, http.MethodGet, "/token?scope=repository:secret:pull", http.StatusForbidden},
+		{"token without certificate", anonymous, http.MethodGet, "/token?scope=repository:engine:pull", http.StatusForbidden},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			req, err := http.NewRequest(c.method, s.URL+c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.client.Do(req)
+			if c.want == 0 {
+				// The TLS handshake fails.
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("got status %d, want an error", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.method, c.path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, c.want)
+			}
+		})
+	}
+
+	// Tokens are only requested for the actions the certificate allows.
+	if got, want := up.lastScope(), "repository:example/engine:pull"; got != want {
+		t.Errorf("upstream scope: got %q, want %q", got, want)
+	}
+}
+
+func TestClientCertValidation(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		cert    redirect.ClientCert
+		wantErr string
+	}{
+		{"no names", redirect.ClientCert{Repos: []string{"**"}}, "clientCerts[0]: at least one of names is required"},
+		{"no repos", redirect.ClientCert{Names: []string{"node-*"}}, "clientCerts[0]: at least one of repos is required"},
+		{"unknown action", redirect.ClientCert{Names: []string{"node-*"}, Repos: []string{"**"}, Actions: []string{"delete"}}, `unknown action "delete"`},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := redirect.Config{
+				Routes:      []redirect.Route{{Repo: "example"}},
+				ClientCerts: []redirect.ClientCert{c.cert},
+			}.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
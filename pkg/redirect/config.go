@@ -0,0 +1,346 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config describes every redirection served by a single redirector.
+//
+// It can be written as YAML or JSON, for example:
+//
+//	hosts:
+//	- name: registry.dagger.io
+//	  landing: https://github.com/dagger/dagger
+//	routes:
+//	- host: registry.dagger.io
+//	  upstream: ghcr.io
+//	  repo: dagger
+//	- prefix: unicorns
+//	  upstream: gcr.io
+//	  repo: example
+//	- host: quay.example.dev
+//	  upstream: quay
+//	upstreams:
+//	- name: quay
+//	  url: https://quay.io
+type Config struct {
+	// Landing is where requests for / are redirected, for hosts without a
+	// landing page of their own.
+	Landing string `json:"landing,omitempty"`
+
+	// Hosts configures behavior specific to an incoming host, other than
+	// its routes.
+	Hosts []Host `json:"hosts,omitempty"`
+
+	// Upstreams are the registries routes can redirect to, in addition to
+	// the builtin "ghcr.io", "gcr.io" and "docker.io".
+	Upstreams []Upstream `json:"upstreams,omitempty"`
+
+	Routes []Route `json:"routes"`
+
+	// Auth, if set, makes the redirector issue tokens of its own, instead of
+	// passing token requests through to upstreams.
+	Auth *Auth `json:"auth,omitempty"`
+
+	// ClientCerts, if set, only allow clients with a verified TLS client
+	// certificate to access the repos their certificate's names are allowed.
+	ClientCerts []ClientCert `json:"clientCerts,omitempty"`
+}
+
+// Host configures an incoming host.
+type Host struct {
+	// Name is the incoming request Host, which must have at least one route.
+	Name string `json:"name"`
+
+	// Landing is where requests for / on this host are redirected.
+	Landing string `json:"landing,omitempty"`
+}
+
+// Route maps requests for an incoming host and user-visible repo prefix to a
+// repo on an upstream registry.
+type Route struct {
+	// Host is the incoming request Host this route applies to.
+	// If empty, the route applies to any host that has no routes of its own.
+	Host string `json:"host,omitempty"`
+
+	// Prefix is the user-visible repo prefix.
+	// For example, if Repo is "example" and Prefix is "unicorns",
+	// users hitting example.dev/unicorns/foo/bar will be redirected to
+	// ghcr.io/example/foo/bar.
+	// If Prefix is empty, every repo on the host matches this route.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Upstream is the name of the registry to redirect to, either one of
+	// Config.Upstreams, or the builtin "ghcr.io" (the default), "gcr.io" or
+	// "docker.io".
+	Upstream string `json:"upstream,omitempty"`
+
+	// Fallbacks are the names of upstreams to try in order when Upstream
+	// fails, like mirrors holding the same repos and digests.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// FailoverStatus are the upstream response codes that fail over to the
+	// next upstream, in addition to connection errors and timeouts.
+	// Defaults to 500, 502, 503 and 504.
+	FailoverStatus []int `json:"failoverStatus,omitempty"`
+
+	// Regions are the names of upstreams to prefer in each region the
+	// redirector runs in, like nearby mirrors. They're tried in order before
+	// Upstream and Fallbacks, which are used as-is in other regions.
+	Regions map[string][]string `json:"regions,omitempty"`
+
+	// Repo is the upstream repo to redirect to.
+	// If Repo is empty, example.dev/foo/bar -> ghcr.io/foo/bar
+	Repo string `json:"repo,omitempty"`
+
+	// Renames are applied in order to repo names matched by the route, and
+	// the first matching rule renames the repo upstream.
+	Renames []Rename `json:"renames,omitempty"`
+
+	// Credentials, if set, are used on Upstream for clients that don't send
+	// any, so they can pull private repos without logging in.
+	Credentials *Credentials `json:"credentials,omitempty"`
+
+	// Catalog lists the route's repos served by /v2/_catalog, relative to
+	// Prefix, like "engine". If empty, they're listed from the upstream's
+	// catalog, keeping only those under Repo.
+	Catalog []string `json:"catalog,omitempty"`
+
+	// Blobs is how blob downloads are served: "redirect" (the default)
+	// passes the upstream's redirects on to clients, "stream" follows them
+	// and streams blobs through the redirector, and "reject" refuses blobs
+	// the upstream serves directly rather than streaming them. Blobs the
+	// upstream serves directly are streamed unless they're rejected.
+	Blobs string `json:"blobs,omitempty"`
+}
+
+const defaultLanding = "https://github.com/dagger/dagger"
+
+// prefixlessHosts are hosts that serve the flag-configured repo without
+// requiring the user-visible prefix, for backward compatibility with
+// prefix-less redirects.
+var prefixlessHosts = []string{
+	"registry.dagger.io",
+}
+
+// LoadConfig reads and validates the YAML or JSON config at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(b)
+}
+
+// ParseConfig parses and validates a YAML or JSON config.
+// Unknown fields are rejected, to catch typos before serving.
+func ParseConfig(b []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// FlagConfig returns the Config equivalent to the single redirection
+// configured by the legacy -gcr, -repo and -prefix flags.
+func FlagConfig(host, repo, prefix string) Config {
+	cfg := Config{Routes: []Route{{
+		Upstream: host,
+		Repo:     repo,
+		Prefix:   prefix,
+	}}}
+	if prefix != "" {
+		// Prefixless hosts serve the same repo, but without requiring the prefix.
+		for _, h := range prefixlessHosts {
+			cfg.Routes = append(cfg.Routes, Route{
+				Host:     h,
+				Upstream: host,
+				Repo:     repo,
+			})
+		}
+	}
+	return cfg
+}
+
+// Validate reports every problem with the config, so they can all be fixed
+// before the redirector starts.
+func (c Config) Validate() error {
+	if len(c.Routes) == 0 {
+		return errors.New("config: at least one route is required")
+	}
+	var errs []string
+	if err := validateLanding(c.Landing); err != nil {
+		errs = append(errs, fmt.Sprintf("landing: %v", err))
+	}
+	upstreams := map[string]bool{}
+	for _, u := range builtinUpstreams {
+		upstreams[u.Name] = true
+	}
+	configured := map[string]int{}
+	for i, u := range c.Upstreams {
+		where := fmt.Sprintf("upstreams[%d]", i)
+		for _, err := range u.validate() {
+			errs = append(errs, fmt.Sprintf("%s: %s", where, err))
+		}
+		if j, ok := configured[u.Name]; ok {
+			errs = append(errs, fmt.Sprintf("%s: duplicates name %q of upstreams[%d]", where, u.Name, j))
+		}
+		configured[u.Name] = i
+		upstreams[u.Name] = true
+	}
+	seen := map[string]int{}
+	routed := map[string]bool{}
+	for i, rt := range c.Routes {
+		where := fmt.Sprintf("routes[%d]", i)
+		if rt.Host != "" && strings.ContainsAny(rt.Host, "/ ") {
+			errs = append(errs, fmt.Sprintf("%s: invalid host %q", where, rt.Host))
+		}
+		if rt.Upstream != "" && !upstreams[rt.Upstream] {
+			errs = append(errs, fmt.Sprintf("%s: unknown upstream %q", where, rt.Upstream))
+		}
+		for j, name := range rt.Fallbacks {
+			if !upstreams[name] {
+				errs = append(errs, fmt.Sprintf("%s: fallbacks[%d]: unknown upstream %q", where, j, name))
+			}
+		}
+		for _, region := range sortedKeys(rt.Regions) {
+			if region == "" {
+				errs = append(errs, fmt.Sprintf("%s: regions: empty region name", where))
+			}
+			for j, name := range rt.Regions[region] {
+				if !upstreams[name] {
+					errs = append(errs, fmt.Sprintf("%s: regions[%s][%d]: unknown upstream %q", where, region, j, name))
+				}
+			}
+		}
+		for j, code := range rt.FailoverStatus {
+			if code < 100 || code > 599 {
+				errs = append(errs, fmt.Sprintf("%s: failoverStatus[%d]: invalid status %d", where, j, code))
+			}
+		}
+		for _, f := range []struct{ name, value string }{{"prefix", rt.Prefix}, {"repo", rt.Repo}} {
+			if err := validateRepoPath(f.value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid %s %q: %v", where, f.name, f.value, err))
+			}
+		}
+		for j, rn := range rt.Renames {
+			if err := rn.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: renames[%d]: %v", where, j, err))
+			}
+		}
+		for j, name := range rt.Catalog {
+			if err := validateRepoPath(name); err != nil || name == "" {
+				if err == nil {
+					err = errors.New("empty name")
+				}
+				errs = append(errs, fmt.Sprintf("%s: catalog[%d]: invalid repo %q: %v", where, j, name, err))
+			}
+		}
+		if !validBlobPolicy(rt.Blobs) {
+			errs = append(errs, fmt.Sprintf("%s: blobs: unknown policy %q", where, rt.Blobs))
+		}
+		if rt.Credentials != nil {
+			for _, err := range rt.Credentials.validate() {
+				errs = append(errs, fmt.Sprintf("%s: credentials: %s", where, err))
+			}
+		}
+		key := strings.ToLower(rt.Host) + "/" + rt.Prefix
+		if j, ok := seen[key]; ok {
+			errs = append(errs, fmt.Sprintf("%s: duplicates host %q and prefix %q of routes[%d]", where, rt.Host, rt.Prefix, j))
+		}
+		seen[key] = i
+		routed[strings.ToLower(rt.Host)] = true
+	}
+	if c.Auth != nil {
+		for _, err := range c.Auth.validate() {
+			errs = append(errs, fmt.Sprintf("auth: %s", err))
+		}
+	}
+	for i, cc := range c.ClientCerts {
+		for _, err := range cc.validate() {
+			errs = append(errs, fmt.Sprintf("clientCerts[%d]: %s", i, err))
+		}
+	}
+	hosts := map[string]int{}
+	for i, h := range c.Hosts {
+		where := fmt.Sprintf("hosts[%d]", i)
+		name := strings.ToLower(h.Name)
+		switch {
+		case name == "":
+			errs = append(errs, fmt.Sprintf("%s: name is required", where))
+		case !routed[name]:
+			errs = append(errs, fmt.Sprintf("%s: host %q has no routes", where, h.Name))
+		}
+		if j, ok := hosts[name]; ok {
+			errs = append(errs, fmt.Sprintf("%s: duplicates host %q of hosts[%d]", where, h.Name, j))
+		}
+		hosts[name] = i
+		if err := validateLanding(h.Landing); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: landing: %v", where, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateLanding checks that a landing page, if set, is an absolute URL.
+func validateLanding(landing string) error {
+	if landing == "" {
+		return nil
+	}
+	u, err := url.Parse(landing)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", landing)
+	}
+	return nil
+}
+
+// validateRepoPath checks that a prefix or repo is a plausible slash-separated
+// repository path, without leading or trailing slashes.
+func validateRepoPath(p string) error {
+	if p == "" {
+		return nil
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" {
+			return errors.New("empty path component")
+		}
+		if part != strings.ToLower(part) {
+			return errors.New("must be lowercase")
+		}
+		if strings.ContainsAny(part, ":@ ") {
+			return errors.New("invalid character")
+		}
+	}
+	return nil
+}
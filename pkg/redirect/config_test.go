@@ -0,0 +1,84 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		config  string
+		wantErr string
+	}{{
+		desc: "yaml",
+		config: `
+landing: https://example.dev
+hosts:
+- name: registry.dagger.io
+  landing: https://github.com/dagger/dagger
+routes:
+- host: registry.dagger.io
+  upstream: ghcr.io
+  repo: dagger
+- prefix: unicorns
+  upstream: gcr.io
+  repo: example
+`,
+	}, {
+		desc:   "json",
+		config: `{"routes":[{"prefix":"unicorns","repo":"example"}]}`,
+	}, {
+		desc:    "no routes",
+		config:  `routes: []`,
+		wantErr: "at least one route",
+	}, {
+		desc:    "unknown field",
+		config:  `{"routes":[{"repository":"example"}]}`,
+		wantErr: "unknown field",
+	}, {
+		desc:    "unknown upstream",
+		config:  `{"routes":[{"upstream":"example.com"}]}`,
+		wantErr: `unknown upstream "example.com"`,
+	}, {
+		desc:    "trailing slash",
+		config:  `{"routes":[{"prefix":"unicorns/"}]}`,
+		wantErr: `invalid prefix "unicorns/"`,
+	}, {
+		desc:    "duplicate route",
+		config:  `{"routes":[{"prefix":"unicorns"},{"prefix":"unicorns","repo":"example"}]}`,
+		wantErr: "duplicates host",
+	}, {
+		desc:    "host without routes",
+		config:  `{"hosts":[{"name":"example.dev"}],"routes":[{"repo":"example"}]}`,
+		wantErr: `host "example.dev" has no routes`,
+	}, {
+		desc:    "relative landing",
+		config:  `{"landing":"/docs","routes":[{"repo":"example"}]}`,
+		wantErr: `"/docs" is not an absolute URL`,
+	}, {
+		desc:    "unknown blob policy",
+		config:  `{"routes":[{"repo":"example","blobs":"proxy"}]}`,
+		wantErr: `blobs: unknown policy "proxy"`,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := redirect.ParseConfig([]byte(c.config))
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("ParseConfig: got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Credentials are the credentials a route uses on its upstream for clients
+// that don't send any, so they can pull private repos without logging in.
+// The upstream sees the redirector's identity instead of the client's.
+//
+// The password, or token, is read from a file or environment variable, so it
+// isn't in the config itself, and it's never logged.
+type Credentials struct {
+	Username string `json:"username"`
+
+	// PasswordFile is the path of a file containing the password, like a
+	// mounted secret. It's read again whenever a token is requested, so it
+	// can be rotated without restarting.
+	PasswordFile string `json:"passwordFile,omitempty"`
+
+	// PasswordEnv is the name of an environment variable containing the
+	// password.
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+}
+
+// validate reports the problems with the credentials' configuration, without
+// reading the password.
+func (c Credentials) validate() []string {
+	var errs []string
+	if c.Username == "" {
+		errs = append(errs, "username is required")
+	}
+	switch {
+	case c.PasswordFile == "" && c.PasswordEnv == "":
+		errs = append(errs, "one of passwordFile and passwordEnv is required")
+	case c.PasswordFile != "" && c.PasswordEnv != "":
+		errs = append(errs, "only one of passwordFile and passwordEnv may be set")
+	}
+	return errs
+}
+
+// authorization returns the Basic Authorization header for the credentials.
+// Errors never include the password.
+func (c Credentials) authorization() (string, error) {
+	var password string
+	if c.PasswordFile != "" {
+		b, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("reading passwordFile: %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	} else {
+		password = os.Getenv(c.PasswordEnv)
+	}
+	if password == "" {
+		return "", errors.New("password is empty")
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+password)), nil
+}
+
+// checkCredentials checks that every route's credentials can be read, so
+// missing secrets are caught before serving.
+func checkCredentials(cfg Config) error {
+	var errs []string
+	for i, rt := range cfg.Routes {
+		if rt.Credentials == nil {
+			continue
+		}
+		if _, err := rt.Credentials.authorization(); err != nil {
+			errs = append(errs, fmt.Sprintf("routes[%d]: credentials: %v", i, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// credentials returns the Authorization header to use on up for clients that
+// don't send any, or "" if the route has no credentials for up. Credentials
+// are only ever used on the route's primary upstream.
+func (rt route) credentials(up *upstream) (string, error) {
+	if rt.config.Credentials == nil || up != rt.primary {
+		return "", nil
+	}
+	return rt.config.Credentials.authorization()
+}
+
+// credentials returns the Authorization header to use on up for clients of
+// rt that don't send any: the route's credentials, or else those from the
+// keychain, if any.
+func (rdr redirect) credentials(rt route, up *upstream) (string, error) {
+	creds, err := rt.credentials(up)
+	if err != nil || creds != "" || rdr.keychain == nil {
+		return creds, err
+	}
+	return rdr.keychain.authorization(up)
+}
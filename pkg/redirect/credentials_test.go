@@ -0,0 +1,238 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+func TestCredentials(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"bot": "s3cret", "alice": "hunter2"}
+	want := up.push(t, "example/engine", "main")
+
+	secret := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes: []redirect.Route{{
+			Upstream:    "fake",
+			Repo:        "example",
+			Credentials: &redirect.Credentials{Username: "bot", PasswordFile: secret},
+		}},
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		headManifest(t, reg, "engine", "main")
+		if got, want := up.lastUser(), "bot"; got != want {
+			t.Errorf("token requested by %q, want %q", got, want)
+		}
+	})
+
+	t.Run("client credentials", func(t *testing.T) {
+		if got := headManifestAs(t, reg, "engine", "main", basic("alice", "hunter2")); got != http.StatusOK {
+			t.Errorf("status: got %d, want %d", got, http.StatusOK)
+		}
+		if got, want := up.lastUser(), "alice"; got != want {
+			t.Errorf("token requested by %q, want %q", got, want)
+		}
+	})
+
+	t.Run("anonymous client token", func(t *testing.T) {
+		got, err := crane.Digest(reg+"/engine:main", crane.WithTransport(forwardedHTTP{}))
+		if err != nil {
+			t.Fatalf("digest: %v", err)
+		}
+		if got != want {
+			t.Errorf("got digest %s, want %s", got, want)
+		}
+		if got, want := up.lastUser(), "bot"; got != want {
+			t.Errorf("token requested by %q, want %q", got, want)
+		}
+	})
+
+	t.Run("anonymous clients can only pull", func(t *testing.T) {
+		resp, err := http.Get("http://" + reg + "/token?scope=repository:engine:pull,push")
+		if err != nil {
+			t.Fatalf("token: %v", err)
+		}
+		resp.Body.Close()
+		if got, want := up.lastScope(), "repository:example/engine:pull"; got != want {
+			t.Errorf("scope: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("anonymous clients only get repos", func(t *testing.T) {
+		for _, c := range []struct {
+			query string
+			want  string
+		}{
+			{"scope=registry:catalog:*", ""},
+			{"scope=repository:engine:pull&scope=registry:catalog:*", "repository:example/engine:pull"},
+		} {
+			resp, err := http.Get("http://" + reg + "/token?" + c.query)
+			if err != nil {
+				t.Fatalf("token: %v", err)
+			}
+			resp.Body.Close()
+			if got := up.lastScope(); got != c.want {
+				t.Errorf("%s: got scope %q, want %q", c.query, got, c.want)
+			}
+		}
+	})
+
+	t.Run("client credentials get other resources", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+reg+"/token?scope=registry:catalog:*", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("alice", "hunter2")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("token: %v", err)
+		}
+		resp.Body.Close()
+		if got, want := up.lastScope(), "registry:catalog:*"; got != want {
+			t.Errorf("scope: got %q, want %q", got, want)
+		}
+		if got, want := up.lastUser(), "alice"; got != want {
+			t.Errorf("token requested by %q, want %q", got, want)
+		}
+	})
+}
+
+func TestCredentialsNotSentToFallbacks(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	mirror := newFakeUpstream(t)
+	mirror.push(t, "example/engine", "main")
+	t.Setenv("REDIRECT_TEST_PASSWORD", "s3cret")
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{
+			{Name: "primary", URL: unavailable.URL},
+			mirror.upstream("mirror"),
+		},
+		Routes: []redirect.Route{{
+			Upstream:    "primary",
+			Fallbacks:   []string{"mirror"},
+			Repo:        "example",
+			Credentials: &redirect.Credentials{Username: "bot", PasswordEnv: "REDIRECT_TEST_PASSWORD"},
+		}},
+	})
+
+	headManifest(t, reg, "engine", "main")
+	if got := mirror.lastUser(); got != "" {
+		t.Errorf("token requested from the fallback by %q, want anonymous", got)
+	}
+}
+
+func TestCredentialsRefreshTokens(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"bot": "s3cret"}
+	host := strings.TrimPrefix(up.URL, "http://")
+	t.Setenv("REDIRECT_TEST_PASSWORD", "s3cret")
+
+	for _, c := range []struct {
+		desc string
+		cfg  redirect.Route
+		opts []redirect.Option
+	}{{
+		desc: "route credentials",
+		cfg: redirect.Route{
+			Upstream:    "fake",
+			Repo:        "example",
+			Credentials: &redirect.Credentials{Username: "bot", PasswordEnv: "REDIRECT_TEST_PASSWORD"},
+		},
+	}, {
+		desc: "keychain password",
+		cfg:  redirect.Route{Upstream: "fake", Repo: "example"},
+		opts: []redirect.Option{redirect.WithKeychain(&fakeKeychain{auths: map[string]authn.AuthConfig{
+			host: {Username: "bot", Password: "s3cret"},
+		}})},
+	}, {
+		desc: "keychain identity token",
+		cfg:  redirect.Route{Upstream: "fake", Repo: "example"},
+		opts: []redirect.Option{redirect.WithKeychain(&fakeKeychain{auths: map[string]authn.AuthConfig{
+			host: {IdentityToken: "fake-refresh-for-bot"},
+		}})},
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			reg := newRedirector(t, redirect.Config{
+				Upstreams: []redirect.Upstream{up.upstream("fake")},
+				Routes:    []redirect.Route{c.cfg},
+			}, c.opts...)
+			// Discover the upstream's token service.
+			if _, err := http.Get("http://" + reg + "/v2/"); err != nil {
+				t.Fatalf("v2: %v", err)
+			}
+
+			// Anonymous clients asking for refresh tokens mustn't get ones
+			// for the redirector's identity, which they could keep.
+			resp, err := http.Get("http://" + reg + "/token?scope=repository:engine:pull&offline_token=true&access_type=offline&client_id=x")
+			if err != nil {
+				t.Fatalf("token: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			var body map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decoding token response: %v", err)
+			}
+			if _, ok := body["refresh_token"]; ok {
+				t.Errorf("got refresh_token in %v, want none", body)
+			}
+			if body["token"] == nil {
+				t.Errorf("got no token in %v", body)
+			}
+			_, params := up.lastRequest()
+			if params.Get("offline_token") != "" || params.Get("access_type") != "" || params.Get("client_id") == "x" {
+				t.Errorf("got token request params %v, want the client's dropped", params)
+			}
+		})
+	}
+}
+
+func TestCredentialsValidation(t *testing.T) {
+	t.Setenv("REDIRECT_TEST_EMPTY", "")
+	for _, c := range []struct {
+		desc    string
+		creds   redirect.Credentials
+		wantErr string
+	}{
+		{"no username", redirect.Credentials{PasswordEnv: "HOME"}, "username is required"},
+		{"no password", redirect.Credentials{Username: "bot"}, "one of passwordFile and passwordEnv is required"},
+		{"both", redirect.Credentials{Username: "bot", PasswordEnv: "HOME", PasswordFile: "/dev/null"}, "only one of"},
+		{"missing file", redirect.Credentials{Username: "bot", PasswordFile: "/does/not/exist"}, "reading passwordFile"},
+		{"empty env", redirect.Credentials{Username: "bot", PasswordEnv: "REDIRECT_TEST_EMPTY"}, "password is empty"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			creds := c.creds
+			_, err := redirect.NewFromConfig(redirect.Config{
+				Routes: []redirect.Route{{Repo: "example", Credentials: &creds}},
+			})
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
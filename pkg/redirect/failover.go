@@ -0,0 +1,97 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"knative.dev/pkg/logging"
+)
+
+// defaultFailoverStatus are the upstream response codes that, unless
+// configured otherwise, cause requests to be retried on the next upstream.
+var defaultFailoverStatus = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// errNoAuth is returned when building a token request for an upstream that
+// doesn't require auth.
+var errNoAuth = errors.New("upstream doesn't require auth")
+
+// statusError is an upstream's error response to a request made while
+// building the request to send, like a token request.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e statusError) Error() string { return e.status }
+
+// newRequestFunc builds the request to send to up, one of the route's
+// upstreams. Region upstreams may be tried before the primary upstream, so
+// requests that depend on it compare up with route.primary.
+type newRequestFunc func(up *upstream) (*http.Request, error)
+
+// send sends the request built for each of the route's upstreams in turn,
+// until one responds without a connection error or a failover status.
+// It returns the last upstream's response, even if it's a failover status,
+// and which upstream sent it.
+func (rt route) send(ctx context.Context, rtr http.RoundTripper, newReq newRequestFunc) (*http.Response, *upstream, error) {
+	logger := logging.FromContext(ctx)
+	var lastErr error
+	for i, up := range rt.upstreams {
+		req, err := newReq(up)
+		var se statusError
+		if errors.Is(err, errNoAuth) || errors.As(err, &se) && !rt.failover[se.code] {
+			return nil, up, err
+		}
+		if err == nil {
+			var resp *http.Response
+			resp, err = rtr.RoundTrip(req.WithContext(ctx))
+			if err == nil {
+				if !rt.failover[resp.StatusCode] || i == len(rt.upstreams)-1 {
+					return resp, up, nil
+				}
+				io.Copy(io.Discard, resp.Body) //nolint:errcheck
+				resp.Body.Close()
+				err = errors.New(resp.Status)
+			}
+		}
+		lastErr = err
+		if i < len(rt.upstreams)-1 {
+			logger.Warnw("upstream failed, failing over",
+				"upstream", up.Name,
+				"next", rt.upstreams[i+1].Name,
+				"error", err)
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// followRedirects is a RoundTripper that follows redirects, like
+// http.Client, for requests whose responses are relayed after redirects.
+type followRedirects struct{}
+
+func (followRedirects) RoundTrip(req *http.Request) (*http.Response, error) {
+	return client.Do(req)
+}
+
+// requestURL returns the URL resp was requested from, before any redirects
+// followRedirects followed, which may be signed URLs to blob storage that
+// aren't for clients' eyes.
+func requestURL(resp *http.Response) string {
+	req := resp.Request
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req.URL.String()
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+func TestFailover(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, c := range []struct {
+		desc           string
+		primary        string
+		failoverStatus []int
+	}{
+		{"unavailable", unavailable.URL, nil},
+		{"connection refused", closed.URL, nil},
+		{"configured status", notFound.URL, []int{http.StatusNotFound}},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			mirror := newFakeUpstream(t)
+			want := mirror.push(t, "example/engine", "main")
+
+			reg := newRedirector(t, redirect.Config{
+				Upstreams: []redirect.Upstream{
+					{Name: "primary", URL: c.primary},
+					mirror.upstream("mirror"),
+				},
+				Routes: []redirect.Route{{
+					Upstream:       "primary",
+					Fallbacks:      []string{"mirror"},
+					FailoverStatus: c.failoverStatus,
+					Repo:           "example",
+				}},
+			})
+
+			got, err := crane.Digest(reg+"/engine:main", crane.WithTransport(forwardedHTTP{}))
+			if err != nil {
+				t.Fatalf("digest: %v", err)
+			}
+			if got != want {
+				t.Errorf("got digest %s, want %s", got, want)
+			}
+
+			resp, err := http.Head("http://" + reg + "/v2/engine/manifests/main")
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("X-Redirected"); !strings.HasPrefix(got, mirror.URL) {
+				t.Errorf("got X-Redirected %q, want the mirror %s", got, mirror.URL)
+			}
+		})
+	}
+}
+
+func TestNoFailover(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	mirror := newFakeUpstream(t)
+	mirror.push(t, "example/engine", "main")
+
+	// 404s aren't failed over by default.
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{
+			{Name: "primary", URL: notFound.URL, TokenURL: notFound.URL + "/token"},
+			mirror.upstream("mirror"),
+		},
+		Routes: []redirect.Route{{
+			Upstream:  "primary",
+			Fallbacks: []string{"mirror"},
+			Repo:      "example",
+		}},
+	})
+	resp, err := http.Head("http://" + reg + "/v2/engine/manifests/main")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("got status %d, want an error from the primary", resp.StatusCode)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	home := newFakeUpstream(t)
+	homeDigest := home.push(t, "example/engine", "main")
+	nearby := newFakeUpstream(t)
+	nearbyDigest := nearby.push(t, "example/engine", "main")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg := redirect.Config{
+		Upstreams: []redirect.Upstream{
+			home.upstream("home"),
+			nearby.upstream("nearby"),
+			{Name: "down", URL: down.URL},
+		},
+		Routes: []redirect.Route{{
+			Upstream: "home",
+			Repo:     "example",
+			Regions: map[string][]string{
+				"sin": {"nearby"},
+				"cdg": {"down"},
+			},
+		}},
+	}
+	for _, c := range []struct {
+		region, want string
+	}{
+		{"sin", nearbyDigest},
+		{"ord", homeDigest},
+		{"", homeDigest},
+		// Unavailable regional upstreams fail over to the default.
+		{"cdg", homeDigest},
+	} {
+		t.Run(c.region, func(t *testing.T) {
+			reg := newRedirector(t, cfg, redirect.WithRegion(c.region))
+			got, err := crane.Digest(reg+"/engine:main", crane.WithTransport(forwardedHTTP{}))
+			if err != nil {
+				t.Fatalf("digest: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("got digest %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRegionCredentials(t *testing.T) {
+	home := newFakeUpstream(t)
+	home.passwords = map[string]string{"alice": "hunter2"}
+	home.push(t, "example/engine", "main")
+	nearby := newFakeUpstream(t)
+	nearby.passwords = map[string]string{"alice": "hunter2"}
+	nearby.push(t, "example/engine", "main")
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{home.upstream("home"), nearby.upstream("nearby")},
+		Routes: []redirect.Route{{
+			Upstream: "home",
+			Repo:     "example",
+			Regions:  map[string][]string{"sin": {"nearby"}},
+		}},
+	}, redirect.WithRegion("sin"))
+	n := home.tokenRequests()
+
+	// The client's credentials are for the primary upstream, so the region's
+	// mirror, which is tried first, only ever sees anonymous requests.
+	if got := headManifestAs(t, reg, "engine", "main", basic("alice", "hunter2")); got != http.StatusOK {
+		t.Fatalf("status: got %d, want %d", got, http.StatusOK)
+	}
+	if got := nearby.lastUser(); got != "" {
+		t.Errorf("manifest: token requested from the mirror by %q, want anonymous", got)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+reg+"/token?scope=repository:engine:pull", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "hunter2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	resp.Body.Close()
+	if got := nearby.lastUser(); got != "" {
+		t.Errorf("token: requested from the mirror by %q, want anonymous", got)
+	}
+
+	if status, _ := postToken(t, reg, url.Values{
+		"grant_type": {"password"},
+		"username":   {"alice"},
+		"password":   {"hunter2"},
+		"scope":      {"repository:engine:pull"},
+	}); status != http.StatusOK {
+		t.Errorf("form token: got status %d, want %d", status, http.StatusOK)
+	}
+	method, params := nearby.lastRequest()
+	if method != http.MethodGet || params.Get("password") != "" {
+		t.Errorf("form token: got %s request to the mirror with params %v, want a GET without the password", method, params)
+	}
+	if got := home.tokenRequests() - n; got != 0 {
+		t.Errorf("got %d token requests to the primary, want none", got)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// signingKey is a private key the redirector signs tokens with.
+type signingKey struct {
+	kid    string
+	alg    string
+	signer crypto.Signer
+}
+
+// loadSigningKey reads a PEM-encoded ECDSA P-256 or RSA private key.
+func loadSigningKey(path string) (signingKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("%s: no PEM block", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	pub, err := newPublicKey(signer.Public())
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return signingKey{kid: pub.kid, alg: pub.alg, signer: signer}, nil
+}
+
+// publicKey is a key tokens are verified with.
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// newPublicKey returns the publicKey for an ECDSA P-256 or RSA key, whose
+// kid is its JWK thumbprint, as described by RFC 7638.
+func newPublicKey(key crypto.PublicKey) (publicKey, error) {
+	pk := publicKey{key: key}
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return publicKey{}, errors.New("only P-256 ECDSA keys are supported")
+		}
+		pk.alg = "ES256"
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return publicKey{}, errors.New("RSA keys must be at least 2048 bits")
+		}
+		pk.alg = "RS256"
+	default:
+		return publicKey{}, fmt.Errorf("unsupported key type %T", key)
+	}
+	// The thumbprint hashes the required members in lexical order, without
+	// whitespace, which is how json.Marshal encodes maps.
+	b, err := json.Marshal(pk.jwk(true))
+	if err != nil {
+		return publicKey{}, err
+	}
+	sum := sha256.Sum256(b)
+	pk.kid = b64(sum[:])
+	return pk, nil
+}
+
+// jwk returns the key as a JWK. If required is true, only the members used
+// to compute its thumbprint are included.
+func (pk publicKey) jwk(required bool) map[string]string {
+	var m map[string]string
+	switch k := pk.key.(type) {
+	case *ecdsa.PublicKey:
+		m = map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   b64(padded(k.X, 32)),
+			"y":   b64(padded(k.Y, 32)),
+		}
+	case *rsa.PublicKey:
+		m = map[string]string{
+			"kty": "RSA",
+			"n":   b64(k.N.Bytes()),
+			"e":   b64(big.NewInt(int64(k.E)).Bytes()),
+		}
+	}
+	if !required {
+		m["kid"] = pk.kid
+		m["alg"] = pk.alg
+		m["use"] = "sig"
+	}
+	return m
+}
+
+// jwks is a JSON Web Key Set, as served for clients to verify tokens with.
+type jwks struct {
+	Keys []map[string]string `json:"keys"`
+}
+
+func newJWKS(keys []publicKey) jwks {
+	set := jwks{Keys: []map[string]string{}}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.jwk(false))
+	}
+	return set
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := make([]byte, size)
+	return n.FillBytes(b)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// signJWT returns the compact serialization of claims, signed with key.
+func signJWT(key signingKey, claims interface{}) (string, error) {
+	h, err := json.Marshal(jwtHeader{Alg: key.alg, Typ: "JWT", Kid: key.kid})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64(h) + "." + b64(p)
+	sum := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch k := key.signer.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS ECDSA signatures are the fixed-size r and s, not ASN.1.
+		sig = append(padded(r, 32), padded(s, 32)...)
+	default:
+		if sig, err = key.signer.Sign(rand.Reader, sum[:], crypto.SHA256); err != nil {
+			return "", err
+		}
+	}
+	return input + "." + b64(sig), nil
+}
+
+// verifyJWT checks the signature of the compact serialized token against
+// the key it names, and unmarshals its claims. It doesn't check the claims.
+func verifyJWT(token string, keys []publicKey, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed token header: %w", err)
+	}
+	var h jwtHeader
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return fmt.Errorf("malformed token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, k := range keys {
+		// Keys are identified by kid if the token names one.
+		if (h.Kid != "" && k.kid != h.Kid) || k.alg != h.Alg {
+			continue
+		}
+		switch pub := k.key.(type) {
+		case *ecdsa.PublicKey:
+			if len(sig) == 64 {
+				r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+				verified = ecdsa.Verify(pub, sum[:], r, s)
+			}
+		case *rsa.PublicKey:
+			verified = rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return errors.New("invalid token signature")
+	}
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token claims: %w", err)
+	}
+	if err := json.Unmarshal(pb, claims); err != nil {
+		return fmt.Errorf("malformed token claims: %w", err)
+	}
+	return nil
+}
+
+// parseJWKS parses the EC P-256 and RSA signing keys in a JSON Web Key Set,
+// ignoring any others.
+func parseJWKS(b []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+	var keys []publicKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var pub crypto.PublicKey
+		switch {
+		case k.Kty == "EC" && k.Crv == "P-256" && (k.Alg == "" || k.Alg == "ES256"):
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("parsing JWKS: key %q: malformed coordinates", k.Kid)
+			}
+			pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("parsing JWKS: key %q: malformed modulus or exponent", k.Kid)
+			}
+			pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		default:
+			continue
+		}
+		pk, err := newPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWKS: key %q: %w", k.Kid, err)
+		}
+		// Keys are named by the issuer's kid, rather than their thumbprint.
+		pk.kid = k.Kid
+		keys = append(keys, pk)
+	}
+	return keys, nil
+}
+
+// peekJWT unmarshals the claims of a token without verifying it, to find
+// out who it claims to be issued by.
+func peekJWT(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token claims: %w", err)
+	}
+	return json.Unmarshal(b, claims)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// keychainTTL is how long credentials resolved from a keychain are used
+// before they're resolved again, so credential helpers aren't run for every
+// request, but rotated logins are still picked up.
+const keychainTTL = time.Minute
+
+// WithKeychain uses credentials from kc for each upstream's registry, like
+// crane does, for clients that don't send any and routes without
+// credentials of their own. authn.DefaultKeychain reads
+// ~/.docker/config.json and runs its credential helpers.
+func WithKeychain(kc authn.Keychain) Option {
+	return func(o *options) { o.keychain = newKeychainCredentials(kc) }
+}
+
+// keychainCredentials resolves and caches Authorization headers for
+// upstreams from a keychain.
+type keychainCredentials struct {
+	kc authn.Keychain
+
+	mu      sync.Mutex
+	headers map[string]keychainHeader // by registry
+}
+
+type keychainHeader struct {
+	header string
+	at     time.Time
+}
+
+func newKeychainCredentials(kc authn.Keychain) *keychainCredentials {
+	return &keychainCredentials{kc: kc, headers: map[string]keychainHeader{}}
+}
+
+// registryResource is an authn.Resource for a registry.
+type registryResource string
+
+func (r registryResource) String() string      { return string(r) }
+func (r registryResource) RegistryStr() string { return string(r) }
+
+// registry returns the name up's credentials are stored under, like the
+// registry in image references.
+func (u *upstream) registry() string {
+	pu, err := url.Parse(u.URL)
+	if err != nil {
+		return ""
+	}
+	// Docker Hub's API host isn't the one logins are stored for.
+	if pu.Host == "registry-1.docker.io" {
+		return "index.docker.io"
+	}
+	return pu.Host
+}
+
+// authorization returns the Authorization header to use on up, or "" if the
+// keychain has no credentials for it. Usernames and passwords are Basic
+// credentials, to be exchanged for tokens, registry tokens are sent as they
+// are, and identity tokens use identityScheme.
+func (k *keychainCredentials) authorization(up *upstream) (string, error) {
+	reg := up.registry()
+	k.mu.Lock()
+	h, ok := k.headers[reg]
+	k.mu.Unlock()
+	if ok && time.Since(h.at) < keychainTTL {
+		return h.header, nil
+	}
+
+	a, err := k.kc.Resolve(registryResource(reg))
+	if err != nil {
+		return "", err
+	}
+	cfg, err := a.Authorization()
+	if err != nil {
+		return "", err
+	}
+	var header string
+	switch {
+	case cfg.RegistryToken != "":
+		header = "Bearer " + cfg.RegistryToken
+	case cfg.IdentityToken != "":
+		header = identityScheme + " " + cfg.IdentityToken
+	case cfg.Auth != "":
+		header = "Basic " + cfg.Auth
+	case cfg.Username != "" || cfg.Password != "":
+		header = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+	}
+	k.mu.Lock()
+	k.headers[reg] = keychainHeader{header, time.Now()}
+	k.mu.Unlock()
+	return header, nil
+}
+
+// identityScheme marks an identity token from a keychain in place of an
+// Authorization header. Identity tokens are OAuth2 refresh tokens, so
+// they're never sent as they are, but exchanged for tokens with the
+// refresh_token grant, like crane does.
+const identityScheme = "Identity"
+
+// identityToken returns the identity token in the Authorization header
+// auth, if it has one.
+func identityToken(auth string) (string, bool) {
+	scheme, token, _ := strings.Cut(auth, " ")
+	return token, scheme == identityScheme && token != ""
+}
+
+// setRefreshGrant sets the form parameters exchanging the identity token
+// refresh for a token.
+func setRefreshGrant(form url.Values, refresh string) {
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refresh)
+	form.Set("client_id", "registry-redirect")
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// fakeKeychain has credentials for registries, like a docker config.
+type fakeKeychain struct {
+	auths map[string]authn.AuthConfig
+
+	mu       sync.Mutex
+	resolved int
+}
+
+func (k *fakeKeychain) Resolve(r authn.Resource) (authn.Authenticator, error) {
+	k.mu.Lock()
+	k.resolved++
+	k.mu.Unlock()
+	cfg, ok := k.auths[r.RegistryStr()]
+	if !ok {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(cfg), nil
+}
+
+func TestKeychain(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"ci": "hunter2", "bot": "hunter3", "robot": "hunter4"}
+	up.push(t, "example/engine", "main")
+	host := strings.TrimPrefix(up.URL, "http://")
+
+	for _, c := range []struct {
+		desc       string
+		auth       authn.AuthConfig
+		wantUser   string
+		wantTokens int
+	}{
+		{"password", authn.AuthConfig{Username: "ci", Password: "hunter2"}, "ci", 1},
+		{"auth", authn.AuthConfig{Auth: "Ym90Omh1bnRlcjM="}, "bot", 1},
+		{"registry token", authn.AuthConfig{RegistryToken: "fake-token-for-ci"}, "", 0},
+		{"identity token", authn.AuthConfig{IdentityToken: "fake-refresh-for-robot"}, "robot", 1},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			kc := &fakeKeychain{auths: map[string]authn.AuthConfig{host: c.auth}}
+			reg := newRedirector(t, redirect.Config{
+				Upstreams: []redirect.Upstream{up.upstream("fake")},
+				Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+			}, redirect.WithKeychain(kc))
+
+			n := up.tokenRequests()
+			for i := 0; i < 2; i++ {
+				if got := headManifestAs(t, reg, "engine", "main", ""); got != http.StatusOK {
+					t.Fatalf("status: got %d, want %d", got, http.StatusOK)
+				}
+			}
+			if got := up.tokenRequests() - n; got != c.wantTokens {
+				t.Errorf("token requests: got %d, want %d", got, c.wantTokens)
+			}
+			if c.wantTokens > 0 {
+				if got := up.lastUser(); got != c.wantUser {
+					t.Errorf("upstream user: got %q, want %q", got, c.wantUser)
+				}
+			}
+			// Credential helpers aren't run for every request.
+			if kc.resolved != 1 {
+				t.Errorf("resolved credentials %d times, want once", kc.resolved)
+			}
+		})
+	}
+
+	// Without credentials for the upstream, clients stay anonymous.
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+	}, redirect.WithKeychain(&fakeKeychain{auths: map[string]authn.AuthConfig{
+		"registry.example.dev": {Username: "ci", Password: "hunter2"},
+	}}))
+	if got := headManifestAs(t, reg, "engine", "main", ""); got != http.StatusOK {
+		t.Fatalf("status: got %d, want %d", got, http.StatusOK)
+	}
+	if got := up.lastUser(); got != "" {
+		t.Errorf("upstream user: got %q, want anonymous", got)
+	}
+}
+
+func TestKeychainTokens(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"ci": "hunter2"}
+	host := strings.TrimPrefix(up.URL, "http://")
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+	}, redirect.WithKeychain(&fakeKeychain{auths: map[string]authn.AuthConfig{
+		host: {Username: "ci", Password: "hunter2"},
+	}}))
+	// Discover the upstream's token service.
+	if _, err := http.Get("http://" + reg + "/v2/"); err != nil {
+		t.Fatalf("v2: %v", err)
+	}
+
+	// Anonymous clients get tokens with the keychain's identity, but only to
+	// pull.
+	resp, err := http.Get("http://" + reg + "/token?scope=repository:engine:pull,push")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := up.lastUser(); got != "ci" {
+		t.Errorf("upstream user: got %q, want ci", got)
+	}
+	if got, want := up.lastScope(), "repository:example/engine:pull"; got != want {
+		t.Errorf("upstream scope: got %q, want %q", got, want)
+	}
+}
+
+func TestKeychainIdentityToken(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"ci": "hunter2"}
+	host := strings.TrimPrefix(up.URL, "http://")
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+	}, redirect.WithKeychain(&fakeKeychain{auths: map[string]authn.AuthConfig{
+		host: {IdentityToken: "fake-refresh-for-ci"},
+	}}))
+	// Discover the upstream's token service.
+	if _, err := http.Get("http://" + reg + "/v2/"); err != nil {
+		t.Fatalf("v2: %v", err)
+	}
+
+	// Identity tokens are refresh tokens, exchanged for pull-only tokens.
+	resp, err := http.Get("http://" + reg + "/token?scope=repository:engine:pull,push")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	method, params := up.lastRequest()
+	if method != http.MethodPost || params.Get("grant_type") != "refresh_token" || params.Get("refresh_token") != "fake-refresh-for-ci" {
+		t.Errorf("got %s token request with params %v, want a refresh_token grant", method, params)
+	}
+	if got := up.lastUser(); got != "ci" {
+		t.Errorf("upstream user: got %q, want ci", got)
+	}
+	if got, want := up.lastScope(), "repository:example/engine:pull"; got != want {
+		t.Errorf("upstream scope: got %q, want %q", got, want)
+	}
+}
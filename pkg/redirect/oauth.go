@@ -0,0 +1,86 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// maxTokenResponse is the largest token response read from an upstream.
+const maxTokenResponse = 1 << 20
+
+// oauthCredentialParams are the OAuth2 form parameters that carry the
+// client's credentials, or only make sense along with them.
+var oauthCredentialParams = []string{"grant_type", "username", "password", "refresh_token", "access_type"}
+
+// tokenParams returns the parameters of a token request, from the query of
+// GET requests, or the form of POST requests, as used by the OAuth2 flow of
+// the distribution token spec. It also returns whether r is a POST.
+func tokenParams(r *http.Request) (url.Values, bool, error) {
+	if r.Method != http.MethodPost {
+		return r.URL.Query(), false, nil
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/x-www-form-urlencoded" {
+		return nil, true, errors.New("token requests must be form encoded")
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, true, err
+	}
+	return r.PostForm, true, nil
+}
+
+// hasOAuthCredentials reports whether the token request parameters include
+// the client's credentials, as a password or a refresh token.
+func hasOAuthCredentials(vals url.Values) bool {
+	return vals.Get("password") != "" || vals.Get("refresh_token") != ""
+}
+
+// oauthError writes an OAuth2 error response, as described by RFC 6749.
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// normalizeTokenResponse returns the token response b with both token and
+// access_token set, if it has either of them. If dropRefresh is set, any
+// refresh_token is removed, so clients given tokens with the redirector's
+// upstream credentials can't keep them. Other fields are left as they are.
+// Responses that aren't JSON objects are returned unchanged.
+func normalizeTokenResponse(b []byte, dropRefresh bool) []byte {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return b
+	}
+	_, hasRefresh := m["refresh_token"]
+	token, hasToken := m["token"]
+	access, hasAccess := m["access_token"]
+	switch {
+	case hasToken == hasAccess:
+		if !dropRefresh || !hasRefresh {
+			return b
+		}
+	case hasToken:
+		m["access_token"] = token
+	default:
+		m["token"] = access
+	}
+	if dropRefresh {
+		delete(m, "refresh_token")
+	}
+	nb, err := json.Marshal(m)
+	if err != nil {
+		return b
+	}
+	return nb
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+// postToken requests a token from the redirector at reg with the OAuth2 form
+// flow, returning the status and the decoded response.
+func postToken(t *testing.T, reg string, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.PostForm("http://"+reg+"/token", form)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body) //nolint:errcheck
+	return resp.StatusCode, body
+}
+
+func TestOAuthToken(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"ci": "hunter2"}
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Prefix: "unicorns", Upstream: "fake", Repo: "example"}},
+	})
+	// Discover the upstream's token service.
+	if _, err := http.Get("http://" + reg + "/v2/"); err != nil {
+		t.Fatalf("v2: %v", err)
+	}
+
+	wantScope := "repository:example/engine:pull repository:example/cli:pull,push"
+	for _, c := range []struct {
+		desc        string
+		form        url.Values
+		want        int
+		wantRefresh string
+	}{{
+		desc: "password",
+		form: url.Values{
+			"grant_type": {"password"},
+			"username":   {"ci"},
+			"password":   {"hunter2"},
+			"client_id":  {"docker"},
+			"service":    {"registry.dagger.io"},
+			"scope":      {"repository:unicorns/engine:pull repository:unicorns/cli:pull,push"},
+		},
+		want: http.StatusOK,
+	}, {
+		desc: "password with refresh token",
+		form: url.Values{
+			"grant_type":  {"password"},
+			"username":    {"ci"},
+			"password":    {"hunter2"},
+			"access_type": {"offline"},
+			"service":     {"registry.dagger.io"},
+			"scope":       {"repository:unicorns/engine:pull repository:unicorns/cli:pull,push"},
+		},
+		want:        http.StatusOK,
+		wantRefresh: "fake-refresh-for-ci",
+	}, {
+		desc: "refresh token",
+		form: url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {"fake-refresh-for-ci"},
+			"service":       {"registry.dagger.io"},
+			"scope":         {"repository:unicorns/engine:pull", "repository:unicorns/cli:pull,push"},
+		},
+		want: http.StatusOK,
+	}, {
+		desc: "wrong password",
+		form: url.Values{
+			"grant_type": {"password"},
+			"username":   {"ci"},
+			"password":   {"hunter3"},
+			"scope":      {"repository:unicorns/engine:pull"},
+		},
+		want: http.StatusBadRequest,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			status, body := postToken(t, reg, c.form)
+			if status != c.want {
+				t.Fatalf("got status %d, want %d", status, c.want)
+			}
+			if c.want != http.StatusOK {
+				return
+			}
+			method, params := up.lastRequest()
+			if method != http.MethodPost {
+				t.Errorf("upstream method: got %s, want POST", method)
+			}
+			if got := params.Get("scope"); got != wantScope {
+				t.Errorf("upstream scope: got %q, want %q", got, wantScope)
+			}
+			if got := params.Get("service"); got != "fake" {
+				t.Errorf("upstream service: got %q, want fake", got)
+			}
+			if got := up.lastUser(); got != "ci" {
+				t.Errorf("upstream user: got %q, want ci", got)
+			}
+			if body["token"] != "fake-token-for-"+wantScope || body["access_token"] != body["token"] {
+				t.Errorf("got token %v and access_token %v, want both fake-token-for-%s", body["token"], body["access_token"], wantScope)
+			}
+			if got, _ := body["refresh_token"].(string); got != c.wantRefresh {
+				t.Errorf("got refresh_token %q, want %q", got, c.wantRefresh)
+			}
+		})
+	}
+
+	// Without credentials, the form flow is sent upstream the GET way.
+	status, body := postToken(t, reg, url.Values{"scope": {"repository:unicorns/engine:pull"}})
+	if status != http.StatusOK {
+		t.Fatalf("anonymous: got status %d, want %d", status, http.StatusOK)
+	}
+	if method, _ := up.lastRequest(); method != http.MethodGet {
+		t.Errorf("anonymous upstream method: got %s, want GET", method)
+	}
+	if body["access_token"] != "fake-token-for-repository:example/engine:pull" {
+		t.Errorf("anonymous: got access_token %v", body["access_token"])
+	}
+
+	resp, err := http.Post("http://"+reg+"/token", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("JSON body: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestOAuthIssuedTokens(t *testing.T) {
+	up := newFakeUpstream(t)
+	key, hash := newKey(t)
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+		Auth: &redirect.Auth{
+			Issuer:      "https://registry.example.dev",
+			SigningKeys: []string{writeKey(t, "ec")},
+			APIKeys:     []redirect.APIKey{{Name: "ci", Hash: hash, Repos: []string{"**"}}},
+		},
+	})
+
+	for _, c := range []struct {
+		desc     string
+		form     url.Values
+		want     int
+		wantCode string
+	}{
+		{"password", url.Values{"grant_type": {"password"}, "username": {"ci"}, "password": {key}, "scope": {"repository:engine:pull"}}, http.StatusOK, ""},
+		{"wrong password", url.Values{"grant_type": {"password"}, "username": {"ci"}, "password": {"rr_nope"}, "scope": {"repository:engine:pull"}}, http.StatusBadRequest, "invalid_grant"},
+		{"refresh token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"abc"}, "scope": {"repository:engine:pull"}}, http.StatusBadRequest, "unsupported_grant_type"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			status, body := postToken(t, reg, c.form)
+			if status != c.want {
+				t.Fatalf("got status %d, want %d", status, c.want)
+			}
+			if c.wantCode != "" && body["error"] != c.wantCode {
+				t.Errorf("got error %v, want %s", body["error"], c.wantCode)
+			}
+			if c.want == http.StatusOK && (body["access_token"] == nil || body["access_token"] != body["token"]) {
+				t.Errorf("got token %v and access_token %v", body["token"], body["access_token"])
+			}
+		})
+	}
+}
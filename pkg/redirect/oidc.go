@@ -0,0 +1,265 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// OIDCIssuer accepts OIDC identity tokens from an issuer, like the workload
+// identity tokens of CI jobs, as the password of Basic credentials, so jobs
+// can authenticate without long-lived secrets. The username is ignored.
+//
+// For example, for GitHub Actions:
+//
+//	name: github
+//	issuer: https://token.actions.githubusercontent.com
+//	audience: registry.dagger.io
+//	jwksURL: https://token.actions.githubusercontent.com/.well-known/jwks
+//	claims:
+//	  repository_owner: dagger
+//	  ref: refs/heads/*
+type OIDCIssuer struct {
+	// Name prefixes the subjects of the issuer's tokens, as "<name>:<sub>",
+	// so grants can tell issuers apart, like "github:repo:dagger/dagger:*".
+	Name string `json:"name"`
+
+	// Issuer is the iss claim of accepted tokens.
+	Issuer string `json:"issuer"`
+
+	// Audience is the aud claim accepted tokens must have.
+	Audience string `json:"audience"`
+
+	// JWKSFile is the path of a file with the issuer's JSON Web Key Set.
+	JWKSFile string `json:"jwksFile,omitempty"`
+
+	// JWKSURL is where the issuer's JSON Web Key Set is served. It's fetched
+	// when needed, and cached.
+	JWKSURL string `json:"jwksURL,omitempty"`
+
+	// Claims are required claims of accepted tokens, by name, and globs
+	// their values must match, where * matches anything.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+// validate reports the problems with the issuer's configuration, without
+// reading its keys.
+func (o OIDCIssuer) validate() []string {
+	var errs []string
+	if o.Name == "" {
+		errs = append(errs, "name is required")
+	}
+	if err := validateURL(o.Issuer); err != nil {
+		errs = append(errs, fmt.Sprintf("issuer: %v", err))
+	}
+	if o.Audience == "" {
+		errs = append(errs, "audience is required")
+	}
+	switch {
+	case o.JWKSFile == "" && o.JWKSURL == "":
+		errs = append(errs, "one of jwksFile and jwksURL is required")
+	case o.JWKSFile != "" && o.JWKSURL != "":
+		errs = append(errs, "only one of jwksFile and jwksURL may be set")
+	case o.JWKSURL != "":
+		if err := validateURL(o.JWKSURL); err != nil {
+			errs = append(errs, fmt.Sprintf("jwksURL: %v", err))
+		}
+	}
+	return errs
+}
+
+const (
+	// jwksTTL is how long keys fetched from a JWKS URL are used before
+	// they're fetched again.
+	jwksTTL = time.Hour
+
+	// jwksMinRefresh limits how often keys are fetched again because a
+	// token is signed by an unknown key.
+	jwksMinRefresh = time.Minute
+
+	// clockSkew is how far tokens' times may be off.
+	clockSkew = time.Minute
+)
+
+// oidcAuthenticator authenticates clients with tokens from an OIDCIssuer.
+type oidcAuthenticator struct {
+	OIDCIssuer
+	claims map[string]*regexp.Regexp
+
+	mu        sync.Mutex
+	keys      []publicKey
+	fetchedAt time.Time
+	// group shares a JWKS fetch between concurrent logins.
+	group singleflight.Group
+}
+
+// newOIDCAuthenticator reads the issuer's keys from its JWKSFile, if set.
+func newOIDCAuthenticator(o OIDCIssuer) (*oidcAuthenticator, error) {
+	a := &oidcAuthenticator{OIDCIssuer: o, claims: map[string]*regexp.Regexp{}}
+	for name, glob := range o.Claims {
+		re := "^" + strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*") + "$"
+		a.claims[name] = regexp.MustCompile(re)
+	}
+	if o.JWKSFile != "" {
+		b, err := os.ReadFile(o.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.keys, err = parseJWKS(b); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *oidcAuthenticator) authenticate(r *http.Request) (identity, bool, error) {
+	_, token, ok := r.BasicAuth()
+	if !ok {
+		return identity{}, false, nil
+	}
+	var peek struct {
+		Issuer string `json:"iss"`
+	}
+	if err := peekJWT(token, &peek); err != nil || peek.Issuer != a.Issuer {
+		// Not a token, or not one of ours.
+		return identity{}, false, nil
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return identity{}, false, fmt.Errorf("%s token: %w", a.Name, err)
+	}
+	sub, _ := claims["sub"].(string)
+	return identity{subject: a.Name + ":" + sub}, true, nil
+}
+
+// verify returns the claims of an OIDC token, if it's valid now and has the
+// required claims.
+func (a *oidcAuthenticator) verify(token string) (map[string]interface{}, error) {
+	keys, err := a.currentKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := verifyJWT(token, keys, &claims); err != nil {
+		if a.JWKSURL == "" {
+			return nil, err
+		}
+		// The issuer may have rotated its keys since they were fetched.
+		if keys, err = a.currentKeys(true); err != nil {
+			return nil, err
+		}
+		if err := verifyJWT(token, keys, &claims); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	switch {
+	case claims["iss"] != a.Issuer:
+		return nil, errors.New("wrong issuer")
+	case !hasAudience(claims["aud"], a.Audience):
+		return nil, errors.New("wrong audience")
+	case !ok:
+		return nil, errors.New("no expiry")
+	case now.Add(-clockSkew).Unix() >= int64(exp):
+		return nil, errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Unix() < int64(nbf) {
+		return nil, errors.New("not valid yet")
+	}
+
+	names := make([]string, 0, len(a.claims))
+	for name := range a.claims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, ok := claims[name]
+		if !ok || !a.claims[name].MatchString(fmt.Sprint(v)) {
+			return nil, fmt.Errorf("claim %q doesn't match %q", name, a.Claims[name])
+		}
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array of
+// strings, includes audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// currentKeys returns the issuer's keys, fetching them from its JWKSURL if
+// they haven't been yet, they're stale, or refresh is true and they haven't
+// been fetched recently.
+func (a *oidcAuthenticator) currentKeys(refresh bool) ([]publicKey, error) {
+	a.mu.Lock()
+	keys, fetchedAt := a.keys, a.fetchedAt
+	a.mu.Unlock()
+	if a.JWKSURL == "" {
+		return keys, nil
+	}
+	age := time.Since(fetchedAt)
+	if !fetchedAt.IsZero() && age < jwksTTL && (!refresh || age < jwksMinRefresh) {
+		return keys, nil
+	}
+	// Logins waiting on the keys don't hold the lock, and the fetch isn't
+	// canceled with the login that started it.
+	v, err, _ := a.group.Do("", func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.JWKSURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetching JWKS: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("fetching JWKS: %w", err)
+		}
+		keys, err := parseJWKS(b)
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.keys, a.fetchedAt = keys, time.Now()
+		a.mu.Unlock()
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]publicKey), nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// fakeOIDC is an OIDC issuer signing ES256 tokens.
+type fakeOIDC struct {
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+func newFakeOIDC(t *testing.T, kid string) *fakeOIDC {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeOIDC{key: key, kid: kid}
+}
+
+func (f *fakeOIDC) jwks() []byte {
+	b, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC",
+		"crv": "P-256",
+		"kid": f.kid,
+		"use": "sig",
+		"x":   base64.RawURLEncoding.EncodeToString(f.key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(f.key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	return b
+}
+
+// sign returns a token with the given claims, and defaults for the rest.
+func (f *fakeOIDC) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	c := map[string]interface{}{
+		"iss":        "https://token.actions.example",
+		"aud":        "registry.example.dev",
+		"sub":        "repo:dagger/dagger:ref:refs/heads/main",
+		"repository": "dagger/dagger",
+		"ref":        "refs/heads/main",
+		"exp":        time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	h, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": f.kid})
+	p, _ := json.Marshal(c)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	sum := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, f.key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDC(t *testing.T) {
+	ci := newFakeOIDC(t, "ci-1")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, ci.jwks(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ci.jwks()) //nolint:errcheck
+	}))
+	defer jwksServer.Close()
+
+	for _, src := range []struct {
+		desc string
+		oidc redirect.OIDCIssuer
+	}{
+		{"file", redirect.OIDCIssuer{JWKSFile: jwksFile}},
+		{"url", redirect.OIDCIssuer{JWKSURL: jwksServer.URL}},
+	} {
+		t.Run(src.desc, func(t *testing.T) {
+			up := newFakeUpstream(t)
+			want := up.push(t, "example/engine", "main")
+			up.push(t, "example/secret", "main")
+
+			oidc := src.oidc
+			oidc.Name = "github"
+			oidc.Issuer = "https://token.actions.example"
+			oidc.Audience = "registry.example.dev"
+			oidc.Claims = map[string]string{"repository": "dagger/*", "ref": "refs/heads/main"}
+			reg := newRedirector(t, redirect.Config{
+				Upstreams: []redirect.Upstream{up.upstream("fake")},
+				Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+				Auth: &redirect.Auth{
+					Issuer:      "https://registry.example.dev",
+					SigningKeys: []string{writeKey(t, "ec")},
+					OIDC:        []redirect.OIDCIssuer{oidc},
+					Grants: []redirect.Grant{{
+						Subjects: []string{"github:repo:dagger/dagger:*"},
+						Repos:    []string{"engine"},
+					}},
+				},
+			})
+
+			pull := func(repo, token string) (string, error) {
+				return crane.Digest(reg+"/"+repo+":main",
+					crane.WithTransport(forwardedHTTP{}),
+					crane.WithAuth(&authn.Basic{Username: "ci", Password: token}))
+			}
+
+			got, err := pull("engine", ci.sign(t, nil))
+			if err != nil {
+				t.Fatalf("digest: %v", err)
+			}
+			if got != want {
+				t.Errorf("got digest %s, want %s", got, want)
+			}
+
+			for _, c := range []struct {
+				desc  string
+				repo  string
+				token string
+			}{
+				{"ungranted repo", "secret", ci.sign(t, nil)},
+				{"ungranted subject", "engine", ci.sign(t, map[string]interface{}{"sub": "repo:dagger/other:ref:refs/heads/main"})},
+				{"claim mismatch", "engine", ci.sign(t, map[string]interface{}{"ref": "refs/heads/feature"})},
+				{"missing claim", "engine", ci.sign(t, map[string]interface{}{"repository": nil})},
+				{"wrong audience", "engine", ci.sign(t, map[string]interface{}{"aud": "ghcr.io"})},
+				{"expired", "engine", ci.sign(t, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})},
+				{"no expiry", "engine", ci.sign(t, map[string]interface{}{"exp": nil})},
+				{"unknown key", "engine", newFakeOIDC(t, "ci-1").sign(t, nil)},
+				{"other issuer", "engine", ci.sign(t, map[string]interface{}{"iss": "https://gitlab.example"})},
+				{"not a token", "engine", "hunter2"},
+			} {
+				t.Run(c.desc, func(t *testing.T) {
+					if _, err := pull(c.repo, c.token); err == nil {
+						t.Error("digest: got nil error")
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestOIDCValidation(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		oidc    redirect.OIDCIssuer
+		wantErr string
+	}{
+		{"no name", redirect.OIDCIssuer{Issuer: "https://ci.example", Audience: "a", JWKSURL: "https://ci.example/jwks"}, "oidc[0]: name is required"},
+		{"no issuer", redirect.OIDCIssuer{Name: "ci", Audience: "a", JWKSURL: "https://ci.example/jwks"}, "oidc[0]: issuer: is required"},
+		{"no audience", redirect.OIDCIssuer{Name: "ci", Issuer: "https://ci.example", JWKSURL: "https://ci.example/jwks"}, "audience is required"},
+		{"no keys", redirect.OIDCIssuer{Name: "ci", Issuer: "https://ci.example", Audience: "a"}, "one of jwksFile and jwksURL is required"},
+		{"both keys", redirect.OIDCIssuer{Name: "ci", Issuer: "https://ci.example", Audience: "a", JWKSURL: "https://ci.example/jwks", JWKSFile: "jwks.json"}, "only one of"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := redirect.Config{
+				Routes: []redirect.Route{{Repo: "example"}},
+				Auth:   &redirect.Auth{Issuer: "https://example.dev", SigningKeys: []string{"key.pem"}, OIDC: []redirect.OIDCIssuer{c.oidc}},
+			}.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCKeysCanceled(t *testing.T) {
+	ci := newFakeOIDC(t, "ci-1")
+	// A JWKS URL that only responds once released.
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	var fetches int32
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		once.Do(func() { close(started) })
+		<-release
+		w.Write(ci.jwks()) //nolint:errcheck
+	}))
+	defer jwksServer.Close()
+	reg := newRedirector(t, redirect.Config{
+		Routes: []redirect.Route{{Repo: "example"}},
+		Auth: &redirect.Auth{
+			Issuer:      "https://registry.example.dev",
+			SigningKeys: []string{writeKey(t, "ec")},
+			OIDC: []redirect.OIDCIssuer{{
+				Name:     "github",
+				Issuer:   "https://token.actions.example",
+				Audience: "registry.example.dev",
+				JWKSURL:  jwksServer.URL,
+			}},
+			Grants: []redirect.Grant{{Subjects: []string{"github:*"}, Repos: []string{"engine"}}},
+		},
+	})
+	login := func(ctx context.Context) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+reg+"/token?scope=repository:engine:pull", nil)
+		if err != nil {
+			return 0, err
+		}
+		req.SetBasicAuth("ci", ci.sign(t, nil))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// The first login gives up while the keys are being fetched, and the
+	// second one, waiting for the same fetch, still gets them.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		login(ctx) //nolint:errcheck
+	}()
+	<-started
+	status := make(chan int)
+	go func() {
+		got, err := login(context.Background())
+		if err != nil {
+			t.Errorf("login: %v", err)
+		}
+		status <- got
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("status: got %d, want %d", got, http.StatusOK)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("JWKS fetches: got %d, want 1", got)
+	}
+}
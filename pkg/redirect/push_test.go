@@ -0,0 +1,187 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestPush(t *testing.T) {
+	up := newFakeUpstream(t)
+	mirror := newFakeUpstream(t)
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake"), mirror.upstream("mirror")},
+		Routes: []redirect.Route{{
+			Prefix:   "unicorns",
+			Upstream: "fake",
+			Repo:     "example",
+			Regions:  map[string][]string{"eu": {"mirror"}},
+		}},
+	}, redirect.WithRegion("eu"))
+	opt := crane.WithTransport(forwardedHTTP{})
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	if err := crane.Push(img, reg+"/unicorns/pushed:v1", opt); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens for pushes come from the primary upstream.
+	if got, want := up.lastScope(), "repository:example/pushed:push,pull"; got != want {
+		t.Errorf("got upstream scope %q, want %q", got, want)
+	}
+
+	// Pushes land on the primary upstream, under the upstream name, even
+	// where pulls prefer a mirror.
+	got, err := crane.Digest(strings.TrimPrefix(up.URL, "http://") + "/example/pushed:v1")
+	if err != nil {
+		t.Fatalf("digest on upstream: %v", err)
+	}
+	if got != want.String() {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+	if _, err := crane.Digest(strings.TrimPrefix(mirror.URL, "http://") + "/example/pushed:v1"); err == nil {
+		t.Error("digest on mirror: got nil error")
+	}
+
+	// Clients writing without a token are challenged to get one from the
+	// redirector.
+	req, err := http.NewRequest(http.MethodPost, "http://"+reg+"/v2/unicorns/pushed/blobs/uploads/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if got := resp.Header.Get("Www-Authenticate"); !strings.Contains(got, `realm="https://`+reg+`/token"`) {
+		t.Errorf("got challenge %q, want realm https://%s/token", got, reg)
+	}
+}
+
+func TestMount(t *testing.T) {
+	up := newFakeUpstream(t)
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes: []redirect.Route{
+			{Prefix: "unicorns", Upstream: "fake", Repo: "example"},
+			{Prefix: "other", Upstream: "fake", Repo: "elsewhere"},
+		},
+	})
+	d := "sha256:" + strings.Repeat("a", 64)
+
+	for _, c := range []struct {
+		desc     string
+		from     string
+		wantFrom string
+	}{
+		{"same route", "unicorns/base", "example/base"},
+		{"other route", "other/base", ""},
+		{"unrouted", "nope/base", ""},
+		{"invalid", "unicorns//base", ""},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			// The token's only needed to get past the fake upstream.
+			req, err := http.NewRequest(http.MethodPost, "http://"+reg+"/v2/unicorns/app/blobs/uploads/?mount="+d+"&from="+c.from, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer fake-token-for-test")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+			}
+			q := up.lastUpload()
+			if got := q.Get("from"); got != c.wantFrom {
+				t.Errorf("upstream from: got %q, want %q", got, c.wantFrom)
+			}
+			if got, want := q.Get("mount"), d; c.wantFrom != "" && got != want {
+				t.Errorf("upstream mount: got %q, want %q", got, want)
+			}
+			if c.wantFrom == "" && q.Get("mount") != "" {
+				t.Errorf("upstream mount: got %q, want none", q.Get("mount"))
+			}
+			if got := resp.Header.Get("Location"); !strings.HasPrefix(got, "/v2/unicorns/app/blobs/uploads/") {
+				t.Errorf("got Location %q, want it under /v2/unicorns/app/blobs/uploads/", got)
+			}
+		})
+	}
+}
+
+func TestMountChallenge(t *testing.T) {
+	// Like distribution, the upstream challenges anonymous mounts for both
+	// the repo and the one the blob is mounted from.
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/uploads/")
+		scope := "repository:" + repo + ":pull,push"
+		if from := r.URL.Query().Get("from"); from != "" {
+			scope += " repository:" + from + ":pull"
+		}
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://auth.example/token",service="fake",scope="%s"`, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer up.Close()
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "fake", URL: up.URL}},
+		Routes: []redirect.Route{{
+			Prefix:   "unicorns",
+			Upstream: "fake",
+			Repo:     "example",
+			Renames:  []redirect.Rename{{Glob: "old", Replace: "new"}},
+		}},
+	})
+	d := "sha256:" + strings.Repeat("a", 64)
+
+	for _, c := range []struct {
+		desc string
+		from string
+		want string
+	}{
+		{"no mount", "", "repository:unicorns/app:pull,push"},
+		{"mount", "unicorns/base", "repository:unicorns/app:pull,push repository:unicorns/base:pull"},
+		{"renamed mount", "unicorns/old", "repository:unicorns/app:pull,push repository:unicorns/old:pull"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			u := "http://" + reg + "/v2/unicorns/app/blobs/uploads/"
+			if c.from != "" {
+				u += "?mount=" + d + "&from=" + c.from
+			}
+			resp, err := http.Post(u, "", nil)
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+			}
+			if got := resp.Header.Get("Www-Authenticate"); !strings.Contains(got, `scope="`+c.want+`"`) {
+				t.Errorf("got challenge %q, want scope %q", got, c.want)
+			}
+		})
+	}
+}
@@ -6,21 +6,23 @@ SPDX-License-Identifier: Apache-2.0
 package redirect
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"knative.dev/pkg/logging"
 )
 
-var prefixlessHosts = map[string]bool{
-	"registry.dagger.io": true,
-}
-
 func redact(in http.Header) http.Header {
 	h := in.Clone()
 	if h.Get("Authorization") != "" {
@@ -29,72 +31,174 @@ func redact(in http.Header) http.Header {
 	return h
 }
 
+// baseURL returns the scheme and host clients used to reach the redirector.
+// TLS is usually terminated before requests reach the redirector, so this is
+// https unless a proxy says otherwise.
+func baseURL(req *http.Request) string {
+	scheme := "https"
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + req.Host
+}
+
+// New returns a handler redirecting requests to repo on host, as configured
+// by the legacy -gcr, -repo and -prefix flags.
 func New(host, repo, prefix string) http.Handler {
-	rdr := redirect{
-		host:   host,
-		repo:   repo,
-		prefix: prefix,
+	return newHandler(FlagConfig(host, repo, prefix), options{}, nil)
+}
+
+// Option configures how a Config is served.
+type Option func(*options)
+
+type options struct {
+	region   string
+	keychain *keychainCredentials
+}
+
+// WithRegion serves each route's upstreams for region, if it has any.
+func WithRegion(region string) Option {
+	return func(o *options) { o.region = region }
+}
+
+// NewFromConfig returns a handler serving every route in cfg, or an error
+// if cfg is invalid.
+func NewFromConfig(cfg Config, opts ...Option) (http.Handler, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkCredentials(cfg); err != nil {
+		return nil, err
 	}
+	var iss *issuer
+	if cfg.Auth != nil {
+		var err error
+		if iss, err = newIssuer(*cfg.Auth); err != nil {
+			return nil, err
+		}
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return newHandler(cfg, o, iss), nil
+}
+
+func newHandler(cfg Config, o options, iss *issuer) http.Handler {
+	hosts := hostRouter{}
+	for name, vh := range newVhosts(cfg, o.region) {
+		hosts[name] = newRouter(redirect{vh, iss, o.keychain, newCertPolicy(cfg.ClientCerts)})
+	}
+	return hosts
+}
+
+// hostRouter dispatches requests to the router for their Host, or to the
+// router keyed by "" if the Host has no routes of its own.
+type hostRouter map[string]http.Handler
+
+func (hr hostRouter) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h, ok := hr[hostName(req.Host)]
+	if !ok {
+		h, ok = hr[""]
+	}
+	if !ok {
+		notFound(resp, req)
+		return
+	}
+	h.ServeHTTP(resp, req)
+}
+
+func newRouter(rdr redirect) http.Handler {
 	router := mux.NewRouter()
 
-	router.Handle("/", http.RedirectHandler("https://github.com/dagger/dagger", http.StatusTemporaryRedirect))
+	router.Handle("/", http.RedirectHandler(rdr.landing, http.StatusTemporaryRedirect))
 
 	router.HandleFunc("/v2", rdr.v2)
 	router.HandleFunc("/v2/", rdr.v2)
 
 	router.HandleFunc("/token", rdr.token)
+	if rdr.issuer != nil {
+		router.HandleFunc("/.well-known/jwks.json", rdr.jwks)
+	}
 
+	router.HandleFunc("/v2/_catalog", rdr.catalog)
 	router.HandleFunc("/v2/{repo:.*}/manifests/{tagOrDigest:.*}", rdr.proxy)
 	router.HandleFunc("/v2/{repo:.*}/blobs/{digest:.*}", rdr.proxy)
 	router.HandleFunc("/v2/{repo:.*}/tags/list", rdr.proxy)
+	router.HandleFunc("/v2/{repo:.*}/referrers/{digest}", rdr.proxy)
 
-	router.NotFoundHandler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		ctx := req.Context()
-		logger := logging.FromContext(ctx)
-		logger.Infow("got request",
-			"method", req.Method,
-			"url", req.URL.String(),
-			"header", redact(req.Header))
-		resp.WriteHeader(http.StatusNotFound)
-	})
+	router.NotFoundHandler = http.HandlerFunc(notFound)
 	return router
 }
 
+func notFound(resp http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	logger := logging.FromContext(ctx)
+	logger.Infow("got request",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"header", redact(req.Header))
+	resp.WriteHeader(http.StatusNotFound)
+}
+
+// redirect serves the routes of a single host.
 type redirect struct {
-	host   string
-	repo   string
-	prefix string
+	vhost
+
+	// issuer is set if the redirector issues its own tokens.
+	issuer *issuer
+
+	// keychain is set if upstream credentials come from a keychain.
+	keychain *keychainCredentials
+
+	// certs is set if clients are authorized by their TLS certificates.
+	certs certPolicy
 }
 
 func (rdr redirect) v2(resp http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 	logger := logging.FromContext(ctx)
 
-	var url string
-	if rdr.host == "gcr.io" {
-		url = "https://gcr.io/v2/"
-	} else {
-		url = "https://ghcr.io/v2/"
+	if rdr.issuer != nil {
+		rdr.v2Auth(resp, req)
+		return
+	}
+
+	rt, ok := rdr.defaultRoute()
+	if !ok {
+		notFound(resp, req)
+		return
 	}
-	out, _ := http.NewRequest(req.Method, url, nil)
 
 	logger.Infow("sending request",
 		"method", req.Method,
 		"url", req.URL.String(),
 		"header", redact(req.Header))
-	resp.Header().Set("X-Redirected", req.URL.String())
 
-	back, err := http.DefaultClient.Do(out)
+	back, up, err := rt.send(ctx, followRedirects{}, func(up *upstream) (*http.Request, error) {
+		var header http.Header
+		if auth := req.Header.Get("Authorization"); isBasic(auth) && up == rt.primary {
+			// Clients logging in to upstreams without a token service send
+			// their Basic credentials here to check them.
+			header = http.Header{"Authorization": {auth}}
+		}
+		return up.newRequest(req.Method, up.v2URL(""), nil, header)
+	})
 	if err != nil {
 		logger.Errorf("Error sending request: %v", err)
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer back.Body.Close()
+	resp.Header().Set("X-Redirected", requestURL(back))
+	if back.StatusCode == http.StatusUnauthorized && up.TokenURL == "" {
+		up.learn(back.Header.Values("Www-Authenticate"))
+	}
 
 	logger.Infow("got response",
 		"method", req.Method,
 		"url", req.URL.String(),
+		"upstream", up.Name,
 		"status", back.Status,
 		"header", redact(back.Header))
 
@@ -102,15 +206,11 @@ func (rdr redirect) v2(resp http.ResponseWriter, req *http.Request) {
 		for _, vv := range v {
 			if k == "Www-Authenticate" {
 				log.Println("=== BEFORE: Www-Authenticate:", vv)
-				if rdr.host == "gcr.io" {
-					// GCR's token endpoint is /v2/token, we want callers to hit us at /token.
-					vv = strings.Replace(vv, `realm="https://gcr.io/v2/`, fmt.Sprintf(`realm="https://%s/`, req.Host), 1)
-				} else {
-					vv = strings.Replace(vv, `realm="https://ghcr.io/`, fmt.Sprintf(`realm="https://%s/`, req.Host), 1)
-				}
+				// The upstream's token endpoint may be anywhere, we want callers to hit us at /token.
+				vv = rewriteChallenge(vv, baseURL(req)+"/token")
 				log.Println("=== CHANGED: Www-Authenticate:", vv)
 			}
-			resp.Header().Add(k, vv)
+			resp.Header().Add(k, up.rewriteHeader(k, vv))
 		}
 	}
 	resp.WriteHeader(back.StatusCode)
@@ -123,55 +223,201 @@ func (rdr redirect) token(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logging.FromContext(ctx)
 
-	vals := r.URL.Query()
-	if rdr.prefix != "" {
-		scope := vals.Get("scope")
-		scope = strings.Replace(scope, rdr.prefix+"/", "", 1)
-		vals.Set("scope", scope)
-	}
-	if rdr.repo != "" {
-		scope := vals.Get("scope")
-		scope = strings.Replace(scope, "repository:", "repository:"+rdr.repo+"/", 1)
-		vals.Set("scope", scope)
+	if rdr.issuer != nil {
+		rdr.issueToken(w, r)
+		return
 	}
 
-	var url string
-	if rdr.host == "gcr.io" {
-		url = "https://gcr.io/v2/token?" + vals.Encode()
-	} else {
-		url = "https://ghcr.io/token?" + vals.Encode()
+	vals, post, err := tokenParams(r)
+	if err != nil {
+		logger.Infow("rejected malformed token request", "error", err)
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	// Clients with credentials of their own may use the OAuth2 form flow,
+	// which is passed on to the primary upstream as it is.
+	clientAuth := r.Header.Get("Authorization") != "" || hasOAuthCredentials(vals)
+	requested, err := parseScopes(vals["scope"])
+	if err != nil {
+		var se scopeError
+		errors.As(err, &se)
+		logger.Infow("rejected malformed scope", "error", err)
+		registryError(w, http.StatusBadRequest, se.code, se.message)
+		return
+	}
+	if rdr.certs != nil {
+		var ok bool
+		if requested, ok = rdr.certScopes(w, r, requested); !ok {
+			return
+		}
+	}
+	// Scopes name user-visible repos, which have to be mapped to their
+	// upstream names.
+	rt, scopes, ok := rdr.routeScopes(requested)
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "no route for requested scope")
+		return
+	}
+	if len(scopes) != len(requested) {
+		logger.Infow("dropped scopes for repos outside the route",
+			"requested", vals["scope"],
+			"prefix", rt.prefix)
+	}
+	for _, s := range scopes {
+		for _, a := range s.actions {
+			if s.typ == "repository" && a == "push" {
+				// Writes only go to the primary upstream, so tokens for them
+				// have to come from it too.
+				rt.upstreams = []*upstream{rt.primary}
+			}
+		}
 	}
 
-	req, _ := http.NewRequest(r.Method, url, nil)
-	req.Header = r.Header.Clone()
-
-	logger.Infow("sending request",
-		"method", req.Method,
-		"url", req.URL.String(),
-		"header", redact(req.Header))
-	w.Header().Set("X-Redirected", req.URL.String())
-
-	resp, err := http.DefaultClient.Do(req)
+	// pullOnly is set if the token is requested with the route's or the
+	// keychain's identity, rather than the client's.
+	var pullOnly bool
+	resp, up, err := rt.send(ctx, followRedirects{}, func(up *upstream) (*http.Request, error) {
+		ts, err := up.tokenService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ts.anonymous {
+			return nil, errNoAuth
+		}
+		header := r.Header.Clone()
+		if up != rt.primary {
+			// Credentials are for the primary upstream, never send them elsewhere.
+			header.Del("Authorization")
+		}
+		form := post && clientAuth && up == rt.primary
+		if !form {
+			header.Del("Content-Type")
+			header.Del("Content-Length")
+		}
+		pullOnly = false
+		var refresh string
+		if !clientAuth {
+			creds, err := rdr.credentials(rt, up)
+			if err != nil {
+				logger.Errorw("reading upstream credentials", "upstream", up.Name, "error", err)
+				return nil, err
+			}
+			// Anonymous clients get tokens with the route's or the
+			// keychain's identity, which must only ever let them pull.
+			if isBasic(creds) {
+				header.Set("Authorization", creds)
+				pullOnly = true
+			}
+			if t, ok := identityToken(creds); ok {
+				refresh, pullOnly = t, true
+			}
+		}
+		q := url.Values{}
+		for k, v := range vals {
+			if pullOnly && k != "service" {
+				// Nor does the identity get anything else the client asks
+				// for, like refresh tokens with offline_token.
+				continue
+			}
+			q[k] = v
+		}
+		if !form {
+			// Requests that aren't the client's form flow, like those to
+			// fallback upstreams, get tokens the GET way, without the
+			// client's credentials.
+			for _, k := range oauthCredentialParams {
+				q.Del(k)
+			}
+		}
+		if ts.service != "" {
+			q.Set("service", ts.service)
+		}
+		q.Del("scope")
+		var upstreamScopes []string
+		for _, s := range scopes {
+			if pullOnly && s.typ != "repository" {
+				// Other resources, like the catalog, aren't limited to the
+				// route's repos, so the route's identity never gets them.
+				continue
+			}
+			if s.typ == "repository" {
+				s.name = rt.upstreamName(up, s.name)
+				if pullOnly {
+					s.actions = []string{"pull"}
+				}
+			}
+			upstreamScopes = append(upstreamScopes, s.String())
+		}
+		if refresh != "" {
+			setRefreshGrant(q, refresh)
+			header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		var req *http.Request
+		if form || refresh != "" {
+			if len(upstreamScopes) > 0 {
+				q.Set("scope", strings.Join(upstreamScopes, " "))
+			}
+			req, err = up.newRequest(http.MethodPost, ts.realm, strings.NewReader(q.Encode()), header)
+		} else {
+			q["scope"] = upstreamScopes
+			method := r.Method
+			if post {
+				method = http.MethodGet
+			}
+			req, err = up.newRequest(method, ts.url(q), nil, header)
+		}
+		if err == nil {
+			logger.Infow("sending request",
+				"method", req.Method,
+				"url", req.URL.String(),
+				"upstream", up.Name,
+				"header", redact(req.Header))
+		}
+		return req, err
+	})
+	if errors.Is(err, errNoAuth) {
+		// Clients only ask for tokens when challenged, so this is unlikely,
+		// but the upstream would accept any token, so make one up.
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"token":"anonymous","access_token":"anonymous"}`)
+		return
+	}
 	if err != nil {
 		logger.Errorf("Error sending request: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
+	w.Header().Set("X-Redirected", requestURL(resp))
 
 	logger.Infow("got response",
-		"method", req.Method,
-		"url", req.URL.String(),
+		"method", r.Method,
+		"url", resp.Request.URL.String(),
+		"upstream", up.Name,
 		"status", resp.Status,
 		"header", redact(resp.Header))
 
+	var body io.Reader = resp.Body
+	if resp.StatusCode == http.StatusOK {
+		// Clients look for either token or access_token, and upstreams may
+		// only send one of them.
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponse))
+		if err != nil {
+			logger.Errorf("Error reading token response: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		b = normalizeTokenResponse(b, pullOnly)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		body = bytes.NewReader(b)
+	}
 	for k, v := range resp.Header {
 		for _, vv := range v {
-			w.Header().Add(k, vv)
+			w.Header().Add(k, up.rewriteHeader(k, vv))
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	if _, err := io.Copy(w, body); err != nil {
 		logger.Errorf("Error copying response body: %v", err)
 	}
 }
@@ -180,76 +426,102 @@ func (rdr redirect) proxy(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logging.FromContext(ctx)
 
-	var url string
-	if rdr.host == "gcr.io" {
-		url = "https://gcr.io/v2/"
-	} else {
-		url = "https://ghcr.io/v2/"
-	}
-	if rdr.repo != "" {
-		url += rdr.repo + "/"
+	// Require a route for the repo, which also requires its prefix, if any.
+	name := mux.Vars(r)["repo"]
+	rt, ok := rdr.match(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"Manifest unknown, prefix required"}]}`)
+		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/v2/")
-	if rdr.prefix != "" && !prefixlessHosts[r.Host] {
-		log.Println("=== BEFORE: path:", path)
-		// Require and trim the prefix, if the request isn't coming from a prefixless host.
-		if !strings.HasPrefix(path, rdr.prefix+"/") {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintln(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"Manifest unknown, prefix required"}]}`)
-			return
-		}
-		path = strings.TrimPrefix(path, rdr.prefix+"/")
-		log.Println("=== AFTER: path:", path)
+	if rdr.certs != nil && !rdr.authorizeCert(w, r, name) {
+		return
 	}
-
-	url += path
-	if query := r.URL.Query().Encode(); query != "" {
-		url += "?" + query
+	if from := r.URL.Query().Get("from"); from != "" && r.Method == http.MethodPost {
+		if reason := rdr.mountDenied(r, rt, from); reason != "" {
+			// Without mount and from, the upstream starts a regular upload,
+			// like registries that can't mount the blob do.
+			logger.Infow("not mounting blob",
+				"repo", name,
+				"from", from,
+				"reason", reason)
+			r = r.Clone(ctx)
+			q := r.URL.Query()
+			q.Del("mount")
+			q.Del("from")
+			r.URL.RawQuery = q.Encode()
+		}
 	}
-	req, _ := http.NewRequest(r.Method, url, nil)
-	req.Header = r.Header.Clone()
-
-	// If the request is coming in without auth, get some auth.
-	// This is useful for testing, but should never happen in real life.
-	// Actually, containerd seems to make unauthenticated HEAD requests before
-	// hitting /v2/, so this might be load-bearing.
-	if req.Header.Get("Authorization") == "" {
-		logger.Warnw("request without Authorization header, getting auth")
-		t, resp, err := rdr.getToken(r)
-		if err != nil {
-			if resp != nil {
-				logger.Infof("Error response getting token: %d %s", resp.StatusCode, resp.Status)
-				http.Error(w, resp.Status, resp.StatusCode)
-				return
-			}
-			logger.Errorf("Error getting token: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if rdr.issuer != nil {
+		if !rdr.authorize(w, r, name) {
 			return
 		}
-		req.Header.Set("Authorization", "Bearer "+t)
+		// The client's token is the redirector's, so it's served upstream
+		// with the route's credentials, or anonymously.
+		r = r.Clone(ctx)
+		r.Header.Del("Authorization")
 	}
 
-	logger.Infow("sending request",
-		"method", req.Method,
-		"url", req.URL.String(),
-		"header", redact(req.Header))
-	w.Header().Set("X-Redirected", req.URL.String())
-
-	resp, err := http.DefaultTransport.RoundTrip(req) // Transport doesn't follow redirects.
+	resp, up, forget, err := rdr.sendUpstream(r, rt, name)
+	var se statusError
+	if errors.As(err, &se) {
+		http.Error(w, se.status, se.code)
+		return
+	}
 	if err != nil {
 		logger.Errorf("Error sending request: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
+	w.Header().Set("X-Redirected", requestURL(resp))
+	upstreamName := rt.upstreamName(up, name)
+	if forget != nil && resp.StatusCode == http.StatusUnauthorized {
+		// The cached token may have been revoked, so don't use it again.
+		forget()
+	}
+	if digest, ok := mux.Vars(r)["digest"]; ok && resp.StatusCode == http.StatusNotFound && strings.Contains(r.URL.Path, "/referrers/") {
+		// The upstream doesn't support the referrers API, so look for
+		// referrers the way clients do without it.
+		rdr.referrersFallback(w, r, rt, name, digest)
+		return
+	}
 
 	logger.Infow("got response",
 		"method", r.Method,
 		"url", r.URL.String(),
+		"upstream", up.Name,
 		"status", resp.Status,
 		"header", redact(resp.Header))
 
+	blob := isBlobRead(r)
+	switch {
+	case blob && isRedirect(resp.StatusCode):
+		blobMetrics.Add("redirected", 1)
+	case blob && servesBlob(r, resp) && rt.blobPolicy() == blobReject:
+		// The route doesn't pay to stream blobs, so don't truncate them
+		// either.
+		blobMetrics.Add("rejected", 1)
+		logger.Infow("rejected blob served by upstream",
+			"repo", name,
+			"upstream", up.Name)
+		registryError(w, http.StatusForbidden, "DENIED", "blobs of "+name+" are only served by redirect, and the upstream served it directly")
+		return
+	}
+
+	// userName returns the name the client knows the upstream repo ur by,
+	// like in the scopes of challenges, which name the repo a blob is
+	// mounted from too.
+	userName := func(ur string) (string, bool) {
+		switch from := r.URL.Query().Get("from"); {
+		case ur == upstreamName:
+			return name, true
+		case from != "" && ur == rt.upstreamName(up, from):
+			return from, true
+		}
+		return rdr.catalogName(rt, up, ur)
+	}
 	for k, v := range resp.Header {
 		for _, vv := range v {
 			// List responses include a response header to support pagination, that looks like:
@@ -258,24 +530,31 @@ func (rdr redirect) proxy(w http.ResponseWriter, r *http.Request) {
 			// In order for the client to be able to use this link, we need to rewrite it to
 			// point to the user's requested repo, not the upstream:
 			//   Link: </v2[/prefix]/static/repo/tags/list?n=100&last=blah>; rel="next">
-			if k == "Link" && strings.HasPrefix(vv, "</v2/"+rdr.repo) {
+			if k == "Link" && strings.HasPrefix(vv, "</v2/"+upstreamName+"/") {
 				log.Println("=== BEFORE: Link:", vv)
-				rest := strings.TrimPrefix(vv, "</v2/"+rdr.repo)
-				vv = "</v2" + rest
-				if rdr.prefix != "" && !prefixlessHosts[r.Host] {
-					vv = "</v2/" + rdr.prefix + rest
-				}
+				vv = "</v2/" + name + strings.TrimPrefix(vv, "</v2/"+upstreamName)
 				log.Println("=== CHANGED: Link:", vv)
 			}
+			// Upload sessions continue at the Location of the previous
+			// response, which has to be the redirector's too.
+			if k == "Location" {
+				vv = rewriteLocation(vv, up, upstreamName, name)
+			}
+			// Clients challenged for a token, like on writes without one,
+			// should get it from the redirector, for the repo they asked for.
+			if k == "Www-Authenticate" {
+				vv = rewriteChallenge(vv, baseURL(r)+"/token")
+				vv = rewriteChallengeScope(vv, userName)
+			}
 
-			w.Header().Add(k, vv)
+			w.Header().Add(k, up.rewriteHeader(k, vv))
 		}
 	}
 
 	// If it's a list request, rewrite the response so the name key matches the
 	// user's requested repo, otherwise clients will repeatedly request the
 	// first page looking for their repo's tags.
-	if rdr.repo != "" && strings.Contains(r.URL.Path, "/tags/list") {
+	if upstreamName != name && strings.HasSuffix(r.URL.Path, "/tags/list") {
 		var lr listResponse
 		if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil {
 			logger.Errorf("Error decoding list response body: %v", err)
@@ -283,7 +562,7 @@ func (rdr redirect) proxy(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		log.Println("=== BEFORE: Name:", lr.Name)
-		lr.Name = strings.Replace(lr.Name, rdr.repo+"/", "", 1)
+		lr.Name = name
 		log.Println("=== CHANGED: Name:", lr.Name)
 
 		// Unset the content-length header from our response, because we're
@@ -302,52 +581,281 @@ func (rdr redirect) proxy(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(resp.StatusCode)
 	}
 
-	// Unless we're serving blobs, also proxy the response body, if any.
-	// Most of the time blob responses will just be 302 redirects to
-	// another location, likely a CDN, but just in case we get a "real"
-	// response we'd like to avoid paying the egress cost to serve it.
+	// Also proxy the response body, if any. Most of the time blob responses
+	// will just be 302 redirects to another location, likely a CDN, but
+	// upstreams that serve them directly, and routes that stream them, have
+	// their bytes counted, since we pay the egress cost to serve them.
 	// Manifests may also be served with redirects, but if they're not,
 	// they're likely small enough we don't mind paying to proxy them.
-	parts := strings.Split(r.URL.Path, "/")
-	if parts[len(parts)-2] != "blobs" {
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			logger.Errorf("Error copying response body: %v", err)
-		}
+	n, err := io.Copy(w, resp.Body)
+	if blob && servesBlob(r, resp) {
+		blobMetrics.Add("streamed", 1)
+		blobMetrics.Add("bytes_streamed", n)
+	}
+	if err != nil {
+		logger.Errorf("Error copying response body: %v", err)
 	}
 }
 
-func (rdr redirect) getToken(r *http.Request) (string, *http.Response, error) {
-	parts := strings.Split(r.URL.Path, "/")
-	parts = parts[2 : len(parts)-2]
-	if rdr.prefix != "" && parts[0] == rdr.prefix {
-		parts = parts[1:]
+// mountDenied returns why a blob can't be mounted from the user-visible repo
+// from into a repo served by rt, or "" if it can. Blobs can only be mounted
+// from repos the client may pull, on the same route, since they're mounted
+// upstream.
+func (rdr redirect) mountDenied(r *http.Request, rt route, from string) string {
+	if err := validateRepoPath(from); err != nil {
+		return "invalid repo: " + err.Error()
 	}
-	if rdr.repo != "" {
-		parts = append([]string{rdr.repo}, parts...)
+	frt, ok := rdr.match(from)
+	if !ok {
+		return "no route for repo"
 	}
-	var url string
-	if rdr.host == "gcr.io" {
-		url = fmt.Sprintf("https://gcr.io/v2/token?scope=repository:%s:pull&service=gcr.io", strings.Join(parts, "/"))
-	} else {
-		url = fmt.Sprintf("https://ghcr.io/token?scope=repository:%s:pull&service=ghcr.io", strings.Join(parts, "/"))
+	// Routes on a host are identified by their prefix.
+	if frt.prefix != rt.prefix {
+		return "repo is outside the route"
+	}
+	pullable, err := rdr.pullable(r)
+	if err != nil {
+		return err.Error()
+	}
+	if !pullable(from) {
+		return "pull not allowed on repo"
+	}
+	return ""
+}
+
+// rewriteLocation rewrites a Location header pointing at upstreamName on up,
+// like an upload session's, to point at the user-visible repo name on the
+// redirector instead. Other locations, like blob storage, are left on the
+// upstream.
+func rewriteLocation(loc string, up *upstream, upstreamName, name string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	if u.Host != "" {
+		base, err := url.Parse(up.URL)
+		if err != nil || !strings.EqualFold(u.Host, base.Host) {
+			return loc
+		}
 	}
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	req.Header = r.Header.Clone()
-	resp, err := http.DefaultClient.Do(req) //nolint:gosec
+	if !strings.HasPrefix(u.Path, "/v2/"+upstreamName+"/") {
+		// Anywhere else on the upstream, like its blob storage, is where
+		// the client goes itself.
+		if base, err := url.Parse(up.URL); err == nil && u.Host == "" {
+			return base.ResolveReference(u).String()
+		}
+		return loc
+	}
+	rel := url.URL{
+		Path:     "/v2/" + name + strings.TrimPrefix(u.Path, "/v2/"+upstreamName),
+		RawQuery: u.RawQuery,
+	}
+	return rel.String()
+}
+
+// sendUpstream sends r, a request for the repo name, to rt's upstreams,
+// getting auth for clients that don't send tokens. It also returns a func to
+// drop the cached token the request used, if any.
+func (rdr redirect) sendUpstream(r *http.Request, rt route, name string) (*http.Response, *upstream, func(), error) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	// Writes only go to the route's primary upstream, since upload sessions
+	// and what's pushed only exist there, and request bodies can only be
+	// sent once.
+	write := requiredAction(r.Method) == "push"
+	if write {
+		rt.upstreams = []*upstream{rt.primary}
+	}
+
+	// Blobs the route streams are fetched from wherever the upstream
+	// redirects, which the client never sees.
+	var tr http.RoundTripper = transport // Transport doesn't follow redirects.
+	if isBlobRead(r) && rt.blobPolicy() == blobStream {
+		tr = followRedirects{}
+	}
+
+	// forget drops the cached token the last request sent used, if any.
+	var forget func()
+	resp, up, err := rt.send(ctx, tr, func(up *upstream) (*http.Request, error) {
+		forget = nil
+		upstreamName := rt.upstreamName(up, name)
+		log.Println("=== REPO:", name, "->", upstreamName)
+
+		target := up.v2URL(upstreamName + strings.TrimPrefix(r.URL.Path, "/v2/"+name))
+		q := r.URL.Query()
+		if from := q.Get("from"); from != "" {
+			// Blobs are mounted from the other repo's upstream name.
+			q.Set("from", rt.upstreamName(up, from))
+		}
+		if query := q.Encode(); query != "" {
+			target += "?" + query
+		}
+		header := r.Header.Clone()
+		if up != rt.primary {
+			// Credentials are for the primary upstream, never send them elsewhere.
+			header.Del("Authorization")
+		}
+		var body io.Reader
+		if write && r.ContentLength != 0 {
+			body = r.Body
+		}
+		req, err := up.newRequest(r.Method, target, body, header)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = r.ContentLength
+		}
+
+		// If the request is coming in without auth, get some auth.
+		// This is useful for testing, but should never happen in real life.
+		// Actually, containerd seems to make unauthenticated HEAD requests before
+		// hitting /v2/, so this might be load-bearing.
+		//
+		// Clients that send Basic credentials straight to the registry API,
+		// like some CI tools and scripts, would have them rejected by
+		// upstreams that only accept bearer tokens, so exchange them for one.
+		//
+		// Anonymous clients use the route's own credentials, if it has any,
+		// but only to write if the redirector authorized the write itself.
+		// Other anonymous writes are sent as they are, so the upstream's
+		// challenge reaches the client.
+		auth := req.Header.Get("Authorization")
+		injected := false
+		if auth == "" && (!write || rdr.issuer != nil) {
+			creds, err := rdr.credentials(rt, up)
+			if err != nil {
+				logger.Errorw("reading upstream credentials", "upstream", up.Name, "error", err)
+				return nil, err
+			}
+			auth, injected = creds, creds != ""
+		}
+		scope := fmt.Sprintf("repository:%s:pull", upstreamName)
+		if write {
+			scope += ",push"
+		}
+		_, identity := identityToken(auth)
+		exchange := auth == "" && !write || isBasic(auth) || identity
+		if exchange {
+			// Upstreams without a token service, like those behind
+			// htpasswd, check Basic credentials themselves.
+			ts, err := up.tokenService(ctx)
+			if err != nil {
+				return nil, err
+			}
+			exchange = !ts.anonymous
+		}
+		switch {
+		case exchange:
+			switch {
+			case injected:
+				logger.Infow("request without Authorization header, getting auth with upstream credentials", "upstream", up.Name)
+			case auth == "":
+				logger.Warnw("request without Authorization header, getting auth", "upstream", up.Name)
+			default:
+				logger.Infow("request with Basic auth, exchanging it for a token", "upstream", up.Name)
+			}
+			t, f, err := rdr.getToken(r, up, scope, auth)
+			var se statusError
+			if errors.As(err, &se) {
+				logger.Infof("Error response getting token: %d %s", se.code, se.status)
+			}
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+t)
+			forget = f
+		case injected && !identity:
+			// Registry tokens from a keychain, and Basic credentials for
+			// upstreams without tokens, are sent as they are. Identity
+			// tokens are never sent.
+			req.Header.Set("Authorization", auth)
+		}
+
+		logger.Infow("sending request",
+			"method", req.Method,
+			"url", req.URL.String(),
+			"upstream", up.Name,
+			"header", redact(req.Header))
+		return req, nil
+	})
+	return resp, up, forget, err
+}
+
+// getToken returns a token for scope on up, and a func to drop it from the
+// cache, or "" if the upstream doesn't require auth. The token is anonymous
+// if auth is empty, or else requested with auth, which is a Basic
+// Authorization header or an identity token.
+func (rdr redirect) getToken(r *http.Request, up *upstream, scope, auth string) (string, func(), error) {
+	ts, err := up.tokenService(r.Context())
 	if err != nil {
 		return "", nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", resp, fmt.Errorf("Error getting token: %v", resp.Status)
+	if ts.anonymous {
+		return "", nil, nil
 	}
-	var t struct {
-		Token string `json:"token"`
+	cache := anonymousTokens
+	if auth != "" {
+		cache = basicTokens
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+	key := tokenKey(up, scope, auth)
+	t, err := cache.get(key, func() (string, time.Duration, error) {
+		vals := url.Values{}
+		vals.Set("scope", scope)
+		if ts.service != "" {
+			vals.Set("service", ts.service)
+		}
+		// Only ever send auth, which is the client's own Basic credentials,
+		// which are removed from requests to fallback upstreams, or the
+		// route's credentials for its primary upstream.
+		header := r.Header.Clone()
+		header.Del("Authorization")
+		var req *http.Request
+		if refresh, ok := identityToken(auth); ok {
+			setRefreshGrant(vals, refresh)
+			header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req, _ = up.newRequest(http.MethodPost, ts.realm, strings.NewReader(vals.Encode()), header)
+		} else {
+			if auth != "" {
+				header.Set("Authorization", auth)
+			}
+			req, _ = up.newRequest(http.MethodGet, ts.url(vals), nil, header)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+		resp, err := client.Do(req.WithContext(ctx)) //nolint:gosec
+		if err != nil {
+			return "", 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", 0, statusError{resp.StatusCode, resp.Status}
+		}
+		var t struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return "", 0, err
+		}
+		if t.Token == "" {
+			t.Token = t.AccessToken
+		}
+		return t.Token, time.Duration(t.ExpiresIn) * time.Second, nil
+	})
+	if err != nil {
 		return "", nil, err
 	}
-	return t.Token, nil, nil
+	return t, func() { cache.forget(key) }, nil
+}
+
+// isBasic reports whether the Authorization header auth has Basic
+// credentials.
+func isBasic(auth string) bool {
+	scheme, _, _ := strings.Cut(auth, " ")
+	return strings.EqualFold(scheme, "Basic")
 }
 
 type listResponse struct {
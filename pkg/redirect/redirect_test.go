@@ -115,3 +115,96 @@ func TestPrefixlessHosts(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefixRequired(t *testing.T) {
+	h, err := redirect.NewFromConfig(redirect.Config{Routes: []redirect.Route{
+		{Prefix: "unicorns", Repo: "dagger"},
+		{Host: "other.example", Prefix: "ponies", Repo: "dagger"},
+	}})
+	if err != nil {
+		t.Fatalf("NewFromConfig: %v", err)
+	}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	for _, c := range []struct {
+		desc    string
+		reqHost string
+		image   string
+	}{
+		{"missing prefix", "example.dev", "engine"},
+		{"prefix of another host", "example.dev", "ponies/engine"},
+		{"host with its own routes", "other.example", "unicorns/engine"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/latest", s.URL, c.image), nil)
+			if err != nil {
+				t.Fatalf("creating request: %v", err)
+			}
+			req.Host = c.reqHost
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			defer resp.Body.Close()
+			all, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+			}
+			if !strings.Contains(string(all), "MANIFEST_UNKNOWN") {
+				t.Errorf("got body %q, want MANIFEST_UNKNOWN", string(all))
+			}
+		})
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	h, err := redirect.NewFromConfig(redirect.Config{
+		Landing: "https://example.dev/docs",
+		Hosts: []redirect.Host{
+			{Name: "registry.dagger.io", Landing: "https://github.com/dagger/dagger"},
+		},
+		Routes: []redirect.Route{
+			{Host: "registry.dagger.io", Repo: "dagger"},
+			{Host: "staging.example.dev", Prefix: "staging", Repo: "dagger"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig: %v", err)
+	}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, c := range []struct {
+		reqHost    string
+		wantStatus int
+		wantLoc    string
+	}{
+		{"registry.dagger.io", http.StatusTemporaryRedirect, "https://github.com/dagger/dagger"},
+		{"REGISTRY.dagger.io:443", http.StatusTemporaryRedirect, "https://github.com/dagger/dagger"},
+		{"staging.example.dev", http.StatusTemporaryRedirect, "https://example.dev/docs"},
+		{"unknown.example.dev", http.StatusNotFound, ""},
+	} {
+		t.Run(c.reqHost, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, s.URL+"/", nil)
+			if err != nil {
+				t.Fatalf("creating request: %v", err)
+			}
+			req.Host = c.reqHost
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, c.wantStatus)
+			}
+			if got := resp.Header.Get("Location"); got != c.wantLoc {
+				t.Errorf("got Location %q, want %q", got, c.wantLoc)
+			}
+		})
+	}
+}
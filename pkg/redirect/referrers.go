@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"knative.dev/pkg/logging"
+)
+
+const ociIndex = "application/vnd.oci.image.index.v1+json"
+
+// maxManifestSize is the largest fallback index read from an upstream, like
+// the manifest size limit of most registries.
+const maxManifestSize = 4 << 20
+
+// referrersIndex is the image index listing a manifest's referrers. Each
+// descriptor is kept as it is, since only its artifactType is needed.
+type referrersIndex struct {
+	SchemaVersion int                      `json:"schemaVersion"`
+	MediaType     string                   `json:"mediaType"`
+	Manifests     []map[string]interface{} `json:"manifests"`
+}
+
+// fallbackTag returns the tag referrers of digest are listed in by clients
+// of registries without the referrers API, like sha256-<hex> for
+// sha256:<hex>.
+func fallbackTag(digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, "/-") {
+		return "", errors.New("invalid digest " + digest)
+	}
+	return alg + "-" + hex, nil
+}
+
+// referrersFallback serves the referrers of digest in the repo name from the
+// index tagged with its fallback tag, as described by the OCI distribution
+// spec for registries that don't support the referrers API. If there's no
+// such index, there are no referrers.
+func (rdr redirect) referrersFallback(w http.ResponseWriter, r *http.Request, rt route, name, digest string) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	tag, err := fallbackTag(digest)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	fr := r.Clone(ctx)
+	fr.Method = http.MethodGet
+	fr.URL.Path = "/v2/" + name + "/manifests/" + tag
+	fr.URL.RawQuery = ""
+	fr.Header.Set("Accept", ociIndex)
+	logger.Infow("upstream doesn't support referrers, trying fallback tag",
+		"repo", name,
+		"tag", tag)
+
+	resp, _, forget, err := rdr.sendUpstream(fr, rt, name)
+	if err != nil {
+		logger.Errorf("Error sending request: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	if forget != nil && resp.StatusCode == http.StatusUnauthorized {
+		forget()
+	}
+
+	idx := referrersIndex{SchemaVersion: 2, MediaType: ociIndex, Manifests: []map[string]interface{}{}}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&idx); err != nil {
+			logger.Errorf("Error decoding fallback index: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		idx.SchemaVersion, idx.MediaType = 2, ociIndex
+		if idx.Manifests == nil {
+			idx.Manifests = []map[string]interface{}{}
+		}
+	case http.StatusNotFound:
+		// No referrers have been pushed.
+	default:
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body) //nolint:errcheck
+		return
+	}
+
+	// Filtering is up to the server with the referrers API, but the
+	// fallback index has every referrer.
+	if at := r.URL.Query().Get("artifactType"); at != "" {
+		filtered := []map[string]interface{}{}
+		for _, m := range idx.Manifests {
+			if m["artifactType"] == at {
+				filtered = append(filtered, m)
+			}
+		}
+		idx.Manifests = filtered
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", ociIndex)
+	if err := json.NewEncoder(w).Encode(idx); err != nil {
+		logger.Errorf("Error encoding referrers: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// rawIndex is an image index pushed as it is.
+type rawIndex []byte
+
+func (i rawIndex) RawManifest() ([]byte, error)        { return i, nil }
+func (i rawIndex) MediaType() (types.MediaType, error) { return types.OCIImageIndex, nil }
+
+// getReferrers gets the referrers of digest in repo from the redirector at
+// reg, returning the status, the OCI-Filters-Applied header and the
+// artifact types of the referrers.
+func getReferrers(t *testing.T, reg, repo, digest, query string) (int, string, []string) {
+	t.Helper()
+	u := "http://" + reg + "/v2/" + repo + "/referrers/" + digest
+	if query != "" {
+		u += "?" + query
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("referrers: %v", err)
+	}
+	defer resp.Body.Close()
+	var idx struct {
+		MediaType string `json:"mediaType"`
+		Manifests []struct {
+			ArtifactType string `json:"artifactType"`
+		} `json:"manifests"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+			t.Fatalf("decoding referrers: %v", err)
+		}
+		if idx.MediaType != "application/vnd.oci.image.index.v1+json" {
+			t.Errorf("got mediaType %q", idx.MediaType)
+		}
+	}
+	artifactTypes := []string{}
+	for _, m := range idx.Manifests {
+		artifactTypes = append(artifactTypes, m.ArtifactType)
+	}
+	return resp.StatusCode, resp.Header.Get("OCI-Filters-Applied"), artifactTypes
+}
+
+func TestReferrersFallback(t *testing.T) {
+	up := newFakeUpstream(t)
+	digest := up.push(t, "example/engine", "main")
+	other := up.push(t, "example/engine", "other")
+
+	// Clients without the referrers API list referrers in an index tagged
+	// with the subject's digest.
+	desc := func(artifactType string) string {
+		return fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":100,"artifactType":%q}`, other, artifactType)
+	}
+	idx := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` +
+		desc("application/vnd.dev.cosign.artifact.sig.v1+json") + "," + desc("application/spdx+json") + "]}"
+	ref, err := name.ParseReference(strings.TrimPrefix(up.URL, "http://") + "/example/engine:" + strings.Replace(digest, ":", "-", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Put(ref, rawIndex(idx)); err != nil {
+		t.Fatalf("pushing fallback index: %v", err)
+	}
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Prefix: "unicorns", Upstream: "fake", Repo: "example"}},
+	})
+
+	for _, c := range []struct {
+		desc        string
+		digest      string
+		query       string
+		want        int
+		wantFilters string
+		wantTypes   []string
+	}{
+		{"all", digest, "", http.StatusOK, "", []string{"application/vnd.dev.cosign.artifact.sig.v1+json", "application/spdx+json"}},
+		{"filtered", digest, "artifactType=application/spdx%2Bjson", http.StatusOK, "artifactType", []string{"application/spdx+json"}},
+		{"none", other, "", http.StatusOK, "", []string{}},
+		{"invalid digest", "latest", "", http.StatusBadRequest, "", []string{}},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			status, filters, artifactTypes := getReferrers(t, reg, "unicorns/engine", c.digest, c.query)
+			if status != c.want {
+				t.Fatalf("got status %d, want %d", status, c.want)
+			}
+			if filters != c.wantFilters {
+				t.Errorf("got OCI-Filters-Applied %q, want %q", filters, c.wantFilters)
+			}
+			if strings.Join(artifactTypes, ",") != strings.Join(c.wantTypes, ",") {
+				t.Errorf("got artifact types %v, want %v", artifactTypes, c.wantTypes)
+			}
+		})
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	// An upstream with the referrers API, which doesn't require auth.
+	var gotPath, gotQuery string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		gotPath, gotQuery = r.URL.Path, r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+		fmt.Fprintln(w, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"artifactType":"application/spdx+json"}]}`)
+	}))
+	defer up.Close()
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "oci", URL: up.URL}},
+		Routes:    []redirect.Route{{Prefix: "unicorns", Upstream: "oci", Repo: "example"}},
+	})
+	d := "sha256:" + strings.Repeat("a", 64)
+	status, filters, artifactTypes := getReferrers(t, reg, "unicorns/engine", d, "artifactType=application/spdx%2Bjson")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", status, http.StatusOK)
+	}
+	if want := "/v2/example/engine/referrers/" + d; gotPath != want {
+		t.Errorf("upstream path: got %q, want %q", gotPath, want)
+	}
+	if want := "artifactType=application%2Fspdx%2Bjson"; gotQuery != want {
+		t.Errorf("upstream query: got %q, want %q", gotQuery, want)
+	}
+	if filters != "artifactType" || len(artifactTypes) != 1 {
+		t.Errorf("got OCI-Filters-Applied %q and artifact types %v", filters, artifactTypes)
+	}
+}
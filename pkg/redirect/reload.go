@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"knative.dev/pkg/logging"
+)
+
+// Reloader serves the handler for the most recently loaded valid config.
+//
+// Reloading swaps the handler atomically: requests already being served
+// complete with the config they started with, and new requests are served
+// with the new config. If the new config is invalid, the old one is kept.
+type Reloader struct {
+	load func() (*Config, error)
+	opts []Option
+
+	mu      sync.Mutex // serializes reloads
+	current atomic.Value
+}
+
+type loaded struct {
+	cfg     Config
+	handler http.Handler
+}
+
+// NewReloader returns a Reloader serving the config returned by load, which
+// is called again on every reload.
+func NewReloader(load func() (*Config, error), opts ...Option) (*Reloader, error) {
+	r := &Reloader{load: load, opts: opts}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the config again, and serves it if it's valid. Otherwise, it
+// returns the error and keeps serving the current config.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+	h, err := NewFromConfig(*cfg, r.opts...)
+	if err != nil {
+		return err
+	}
+	r.current.Store(loaded{cfg: *cfg, handler: h})
+	return nil
+}
+
+// Config returns the config currently being served.
+func (r *Reloader) Config() Config {
+	return r.current.Load().(loaded).cfg
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.current.Load().(loaded).handler.ServeHTTP(w, req)
+}
+
+// Watch reloads whenever the file at path changes, checking every interval,
+// until ctx is done. Failed reloads are logged.
+func (r *Reloader) Watch(ctx context.Context, path string, interval time.Duration) {
+	logger := logging.FromContext(ctx)
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	modTime, size := stat()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mt, sz := stat()
+		if mt.Equal(modTime) && sz == size {
+			continue
+		}
+		modTime, size = mt, sz
+		if err := r.Reload(); err != nil {
+			logger.Errorw("config changed, but reloading failed; keeping the current config",
+				"path", path,
+				"error", err)
+			continue
+		}
+		logger.Infow("reloaded config", "path", path)
+	}
+}
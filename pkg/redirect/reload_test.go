@@ -0,0 +1,119 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+// landing returns where the handler redirects requests for /.
+func landing(t *testing.T, h http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Header().Get("Location")
+}
+
+func TestReload(t *testing.T) {
+	var next *redirect.Config
+	var nextErr error
+	load := func() (*redirect.Config, error) { return next, nextErr }
+
+	next = &redirect.Config{Landing: "https://one.example", Routes: []redirect.Route{{Repo: "dagger"}}}
+	r, err := redirect.NewReloader(load)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	if got, want := landing(t, r), "https://one.example"; got != want {
+		t.Errorf("landing: got %q, want %q", got, want)
+	}
+
+	// A valid config is swapped in.
+	next = &redirect.Config{Landing: "https://two.example", Routes: []redirect.Route{{Repo: "dagger"}}}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got, want := landing(t, r), "https://two.example"; got != want {
+		t.Errorf("landing: got %q, want %q", got, want)
+	}
+
+	// Invalid configs, and configs that fail to load, are rejected, and the
+	// current config is kept.
+	for _, c := range []struct {
+		desc string
+		cfg  *redirect.Config
+		err  error
+	}{
+		{"invalid", &redirect.Config{Landing: "https://three.example"}, nil},
+		{"load error", nil, errors.New("boom")},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			next, nextErr = c.cfg, c.err
+			if err := r.Reload(); err == nil {
+				t.Fatal("Reload: got nil error")
+			}
+			if got, want := landing(t, r), "https://two.example"; got != want {
+				t.Errorf("landing: got %q, want %q", got, want)
+			}
+			if got, want := r.Config().Landing, "https://two.example"; got != want {
+				t.Errorf("Config().Landing: got %q, want %q", got, want)
+			}
+		})
+	}
+
+	if _, err := redirect.NewReloader(load); err == nil {
+		t.Error("NewReloader with a failing load: got nil error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("landing: https://one.example\nroutes:\n- repo: dagger\n")
+
+	r, err := redirect.NewReloader(func() (*redirect.Config, error) { return redirect.LoadConfig(path) })
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, path, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond) // let Watch stat the original file
+
+	waitFor := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if landing(t, r) == want {
+				return
+			}
+		}
+		t.Fatalf("landing: got %q, want %q", landing(t, r), want)
+	}
+
+	write("landing: https://two.example/changed\nroutes:\n- repo: dagger\n")
+	waitFor("https://two.example/changed")
+
+	// An invalid change is ignored, and the next valid one is picked up.
+	write("landing: https://three.example\nroutes: []\n")
+	time.Sleep(100 * time.Millisecond)
+	waitFor("https://two.example/changed")
+	write("landing: https://four.example/changed-again\nroutes:\n- repo: dagger\n")
+	waitFor("https://four.example/changed-again")
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Rename maps user-visible repo names matching a pattern to other upstream
+// repo names. Exactly one of Glob and Regexp must be set.
+//
+// Patterns match the whole repo name, after the route's prefix is removed,
+// and the result is relative to the route's repo, if any. For example,
+//
+//	glob: engine-*
+//	replace: dagger/engine/$1
+//
+// maps engine-gpu to dagger/engine/gpu.
+type Rename struct {
+	// Glob is a pattern where * matches any part of a single path
+	// component, and ** matches anything, including slashes.
+	// Each wildcard is captured, in order, as $1, $2, etc.
+	Glob string `json:"glob,omitempty"`
+
+	// Regexp is a regular expression, whose capture groups can be used in
+	// Replace, like regexp.Expand.
+	Regexp string `json:"regexp,omitempty"`
+
+	// Replace is the new repo name, which can refer to captures.
+	Replace string `json:"replace"`
+}
+
+// compile returns the anchored regular expression matched by the rule.
+func (r Rename) compile() (*regexp.Regexp, error) {
+	switch {
+	case r.Glob != "" && r.Regexp != "":
+		return nil, errors.New("only one of glob and regexp may be set")
+	case r.Glob != "":
+		return regexp.Compile("^" + globToRegexp(r.Glob) + "$")
+	case r.Regexp != "":
+		return regexp.Compile("^(?:" + r.Regexp + ")$")
+	default:
+		return nil, errors.New("one of glob and regexp is required")
+	}
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString("(.*)")
+			i++
+		case glob[i] == '*':
+			b.WriteString("([^/]*)")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// validate reports the problems with a rename rule.
+func (r Rename) validate() error {
+	if _, err := r.compile(); err != nil {
+		return err
+	}
+	if r.Replace == "" {
+		return errors.New("replace is required")
+	}
+	return nil
+}
+
+// rename is a compiled Rename.
+type rename struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+func newRenames(rs []Rename) []rename {
+	out := make([]rename, 0, len(rs))
+	for _, r := range rs {
+		re, err := r.compile()
+		if err != nil {
+			// Rules are validated with the rest of the config.
+			continue
+		}
+		out = append(out, rename{re: re, replace: r.Replace})
+	}
+	return out
+}
+
+// applyRenames returns name renamed by the first matching rule, if any.
+func applyRenames(rs []rename, name string) string {
+	for _, r := range rs {
+		if m := r.re.FindStringSubmatchIndex(name); m != nil {
+			return string(r.re.ExpandString(nil, r.replace, name, m))
+		}
+	}
+	return name
+}
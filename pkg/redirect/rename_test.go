@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+func TestRenames(t *testing.T) {
+	up := newFakeUpstream(t)
+	gpu := up.push(t, "example/engine/gpu", "main")
+	moved := up.push(t, "example/new-home", "main")
+	plain := up.push(t, "example/cli", "main")
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes: []redirect.Route{{
+			Prefix:   "unicorns",
+			Upstream: "fake",
+			Repo:     "example",
+			Renames: []redirect.Rename{
+				{Glob: "engine-*", Replace: "engine/$1"},
+				{Regexp: "old-(home|house)", Replace: "new-home"},
+			},
+		}},
+	})
+	opt := crane.WithTransport(forwardedHTTP{})
+
+	for _, c := range []struct {
+		image, want, wantScope string
+	}{
+		{"unicorns/engine-gpu", gpu, "repository:example/engine/gpu:pull"},
+		{"unicorns/old-house", moved, "repository:example/new-home:pull"},
+		{"unicorns/cli", plain, "repository:example/cli:pull"},
+	} {
+		t.Run(c.image, func(t *testing.T) {
+			got, err := crane.Digest(reg+"/"+c.image+":main", opt)
+			if err != nil {
+				t.Fatalf("digest: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("got digest %s, want %s", got, c.want)
+			}
+			if last := up.lastScope(); last != c.wantScope {
+				t.Errorf("got upstream scope %q, want %q", last, c.wantScope)
+			}
+		})
+	}
+
+	// The tag list names the user-visible repo, not the upstream one.
+	resp, err := http.Get("http://" + reg + "/v2/unicorns/engine-gpu/tags/list")
+	if err != nil {
+		t.Fatalf("listing tags: %v", err)
+	}
+	defer resp.Body.Close()
+	var lr struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil {
+		t.Fatalf("decoding tags: %v", err)
+	}
+	if lr.Name != "unicorns/engine-gpu" {
+		t.Errorf("got name %q, want unicorns/engine-gpu", lr.Name)
+	}
+}
+
+func TestRenameValidation(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		rename  redirect.Rename
+		wantErr string
+	}{
+		{"no pattern", redirect.Rename{Replace: "x"}, "one of glob and regexp is required"},
+		{"both patterns", redirect.Rename{Glob: "x", Regexp: "x", Replace: "x"}, "only one of glob and regexp"},
+		{"bad regexp", redirect.Rename{Regexp: "(", Replace: "x"}, "missing closing )"},
+		{"no replacement", redirect.Rename{Glob: "x"}, "replace is required"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := redirect.Config{Routes: []redirect.Route{{
+				Renames: []redirect.Rename{c.rename},
+			}}}.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("Validate: got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Resolution describes how a reference would be redirected, as worked out
+// from the config alone, without contacting any upstream.
+type Resolution struct {
+	Host      string `json:"host"`
+	Repo      string `json:"repo"`
+	Reference string `json:"reference"`
+
+	// Rejected is set if no route serves the repo, for example because it's
+	// missing the route's prefix, and describes why.
+	Rejected string `json:"rejected,omitempty"`
+
+	// Route is the route serving the repo.
+	Route *Route `json:"route,omitempty"`
+
+	// Upstreams are where the reference is redirected to, in the order
+	// they're tried.
+	Upstreams []ResolvedUpstream `json:"upstreams,omitempty"`
+}
+
+// ResolvedUpstream describes where a reference would be redirected on a
+// single upstream.
+type ResolvedUpstream struct {
+	Upstream    string `json:"upstream"`
+	Repo        string `json:"repo"`
+	ManifestURL string `json:"manifestURL"`
+	Scope       string `json:"scope"`
+}
+
+// Resolve describes how the reference ref, like
+// registry.dagger.io/engine:v0.3.9, would be redirected when serving cfg.
+func Resolve(cfg Config, ref string, opts ...Option) (*Resolution, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return resolve(newVhosts(cfg, o.region), ref)
+}
+
+func resolve(vhs map[string]vhost, ref string) (*Resolution, error) {
+	res, err := parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	vh, ok := vhs[hostName(res.Host)]
+	if !ok {
+		vh, ok = vhs[""]
+	}
+	if !ok {
+		res.Rejected = fmt.Sprintf("no routes for host %q", res.Host)
+		return res, nil
+	}
+	rt, ok := vh.match(res.Repo)
+	if !ok {
+		res.Rejected = "no route matches the repo, prefix required"
+		return res, nil
+	}
+	cfg := rt.config
+	res.Route = &cfg
+	for _, up := range rt.upstreams {
+		name := rt.upstreamName(up, res.Repo)
+		res.Upstreams = append(res.Upstreams, ResolvedUpstream{
+			Upstream:    up.Name,
+			Repo:        name,
+			ManifestURL: up.v2URL(name + "/manifests/" + res.Reference),
+			Scope:       "repository:" + name + ":pull",
+		})
+	}
+	return res, nil
+}
+
+// parseReference splits ref into its host, repo and tag or digest, which
+// defaults to latest.
+func parseReference(ref string) (*Resolution, error) {
+	host, rest, ok := strings.Cut(ref, "/")
+	if !ok || host == "" || rest == "" {
+		return nil, fmt.Errorf("reference %q must look like <host>/<repo>[:<tag>|@<digest>]", ref)
+	}
+	res := &Resolution{Host: host, Repo: rest, Reference: "latest"}
+	if repo, digest, ok := strings.Cut(rest, "@"); ok {
+		res.Repo, res.Reference = repo, digest
+	} else if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		res.Repo, res.Reference = rest[:i], rest[i+1:]
+	}
+	if err := validateRepoPath(res.Repo); err != nil {
+		return nil, fmt.Errorf("invalid repo %q: %w", res.Repo, err)
+	}
+	if res.Reference == "" {
+		return nil, errors.New("empty tag or digest")
+	}
+	return res, nil
+}
+
+// ResolveHandler serves the Resolution of the reference in the ref query
+// parameter as JSON, for debugging. The config should already be valid.
+func ResolveHandler(cfg Config, opts ...Option) http.Handler {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	vhs := newVhosts(cfg, o.region)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := resolve(vhs, r.URL.Query().Get("ref"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(res) //nolint:errcheck
+	})
+}
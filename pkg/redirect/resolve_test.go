@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+func TestResolve(t *testing.T) {
+	cfg := redirect.Config{Routes: []redirect.Route{
+		{Host: "registry.dagger.io", Repo: "dagger", Fallbacks: []string{"docker.io"}},
+		{Prefix: "unicorns", Upstream: "gcr.io", Repo: "example"},
+	}}
+
+	for _, c := range []struct {
+		ref          string
+		wantRejected bool
+		wantURLs     []string
+		wantScope    string
+	}{{
+		ref:       "registry.dagger.io/engine:v0.3.9",
+		wantURLs:  []string{"https://ghcr.io/v2/dagger/engine/manifests/v0.3.9", "https://registry-1.docker.io/v2/dagger/engine/manifests/v0.3.9"},
+		wantScope: "repository:dagger/engine:pull",
+	}, {
+		ref:       "example.dev/unicorns/foo/bar@sha256:abcd",
+		wantURLs:  []string{"https://gcr.io/v2/example/foo/bar/manifests/sha256:abcd"},
+		wantScope: "repository:example/foo/bar:pull",
+	}, {
+		ref:       "localhost:8080/unicorns/foo",
+		wantURLs:  []string{"https://gcr.io/v2/example/foo/manifests/latest"},
+		wantScope: "repository:example/foo:pull",
+	}, {
+		ref:          "example.dev/foo/bar",
+		wantRejected: true,
+	}} {
+		t.Run(c.ref, func(t *testing.T) {
+			res, err := redirect.Resolve(cfg, c.ref)
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if got := res.Rejected != ""; got != c.wantRejected {
+				t.Fatalf("got rejected %q, want rejected %t", res.Rejected, c.wantRejected)
+			}
+			if len(res.Upstreams) != len(c.wantURLs) {
+				t.Fatalf("got %d upstreams, want %d", len(res.Upstreams), len(c.wantURLs))
+			}
+			for i, up := range res.Upstreams {
+				if up.ManifestURL != c.wantURLs[i] {
+					t.Errorf("upstream %d: got manifest URL %s, want %s", i, up.ManifestURL, c.wantURLs[i])
+				}
+			}
+			if len(res.Upstreams) > 0 && res.Upstreams[0].Scope != c.wantScope {
+				t.Errorf("got scope %s, want %s", res.Upstreams[0].Scope, c.wantScope)
+			}
+		})
+	}
+
+	if _, err := redirect.Resolve(cfg, "engine"); err == nil {
+		t.Error("Resolve(engine): expected error without a host")
+	}
+}
+
+func TestResolveHandler(t *testing.T) {
+	s := httptest.NewServer(redirect.ResolveHandler(redirect.Config{Routes: []redirect.Route{
+		{Repo: "dagger"},
+	}}))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/resolve?ref=registry.dagger.io/engine:main")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+	var res redirect.Resolution
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if want := "https://ghcr.io/v2/dagger/engine/manifests/main"; len(res.Upstreams) != 1 || res.Upstreams[0].ManifestURL != want {
+		t.Errorf("got upstreams %+v, want manifest URL %s", res.Upstreams, want)
+	}
+
+	resp, err = http.Get(s.URL + "/resolve?ref=nope")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
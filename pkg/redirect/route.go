@@ -0,0 +1,154 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"net"
+	"strings"
+)
+
+// route is a validated Route, ready to serve requests.
+type route struct {
+	config Route
+
+	host    string
+	prefix  string
+	repo    string
+	renames []rename
+
+	// upstreams are tried in order, until one doesn't fail.
+	upstreams []*upstream
+	failover  map[int]bool
+
+	// primary is the route's configured Upstream.
+	primary *upstream
+}
+
+func newRoute(rt Route, ups map[string]*upstream, region string) route {
+	primary, ok := ups[rt.Upstream]
+	if !ok {
+		primary = ups[defaultUpstream]
+	}
+	r := route{
+		config:   rt,
+		host:     strings.ToLower(rt.Host),
+		prefix:   rt.Prefix,
+		repo:     rt.Repo,
+		renames:  newRenames(rt.Renames),
+		failover: map[int]bool{},
+		primary:  primary,
+	}
+	// Prefer the region's upstreams, then fall back to the defaults.
+	seen := map[*upstream]bool{}
+	names := append([]string{}, rt.Regions[region]...)
+	names = append(names, rt.Upstream)
+	names = append(names, rt.Fallbacks...)
+	for _, name := range names {
+		up, ok := ups[name]
+		if name == rt.Upstream {
+			up, ok = primary, true
+		}
+		if ok && !seen[up] {
+			seen[up] = true
+			r.upstreams = append(r.upstreams, up)
+		}
+	}
+	status := rt.FailoverStatus
+	if len(status) == 0 {
+		status = defaultFailoverStatus
+	}
+	for _, code := range status {
+		r.failover[code] = true
+	}
+	return r
+}
+
+// matches reports whether the user-visible repo name is served by this route.
+func (rt route) matches(name string) bool {
+	return rt.prefix == "" || strings.HasPrefix(name, rt.prefix+"/")
+}
+
+// upstreamName maps a user-visible repo name matched by this route to the
+// repo name on one of its upstream registries.
+func (rt route) upstreamName(up *upstream, name string) string {
+	if rt.prefix != "" {
+		name = strings.TrimPrefix(name, rt.prefix+"/")
+	}
+	name = applyRenames(rt.renames, name)
+	if rt.repo != "" {
+		name = rt.repo + "/" + name
+	}
+	if up.Library && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return name
+}
+
+// vhost is the routing table for a single incoming host, independent of
+// every other host's.
+type vhost struct {
+	landing string
+	routes  []route
+}
+
+// newVhosts returns the routing table for each host configured in cfg, as
+// served in region, keyed by lowercase host name. The table for hosts
+// without routes of their own is keyed by "", if there are any such routes.
+func newVhosts(cfg Config, region string) map[string]vhost {
+	landing := cfg.Landing
+	if landing == "" {
+		landing = defaultLanding
+	}
+	ups := newUpstreams(cfg)
+	vhs := map[string]vhost{}
+	for _, r := range cfg.Routes {
+		rt := newRoute(r, ups, region)
+		vh, ok := vhs[rt.host]
+		if !ok {
+			vh.landing = landing
+		}
+		vh.routes = append(vh.routes, rt)
+		vhs[rt.host] = vh
+	}
+	for _, h := range cfg.Hosts {
+		name := strings.ToLower(h.Name)
+		if vh, ok := vhs[name]; ok && h.Landing != "" {
+			vh.landing = h.Landing
+			vhs[name] = vh
+		}
+	}
+	return vhs
+}
+
+// hostName returns the lowercase name of the request's host, without any port.
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// defaultRoute returns the route serving requests that don't name a repo,
+// like /v2/ and /token without a scope: the first one configured.
+func (vh vhost) defaultRoute() (route, bool) {
+	if len(vh.routes) == 0 {
+		return route{}, false
+	}
+	return vh.routes[0], true
+}
+
+// match returns the route serving the user-visible repo name.
+// The route with the longest matching prefix wins.
+func (vh vhost) match(name string) (route, bool) {
+	var best route
+	found := false
+	for _, rt := range vh.routes {
+		if rt.matches(name) && (!found || len(rt.prefix) > len(best.prefix)) {
+			best, found = rt, true
+		}
+	}
+	return best, found
+}
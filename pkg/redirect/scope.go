@@ -0,0 +1,137 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scope is a single resource scope of a token request, as described by the
+// distribution token scope spec:
+//
+//	resourcetype:resourcename:action[,action]*
+//
+// where the resource type may have a class, like repository(plugin), and
+// the resource name may contain colons, like a host with a port. Repository
+// names are user-visible repo names, though, which never have a host, so
+// ones like localhost:5000/foo are invalid.
+type scope struct {
+	typ     string
+	class   string
+	name    string
+	actions []string
+}
+
+// scopeError is a malformed scope, described with a distribution spec error
+// code.
+type scopeError struct {
+	code    string
+	message string
+}
+
+func (e scopeError) Error() string { return e.message }
+
+// parseScopes parses every scope in the values of scope parameters, each of
+// which may have several space-separated scopes.
+func parseScopes(params []string) ([]scope, error) {
+	var scopes []scope
+	for _, param := range params {
+		for _, s := range strings.Fields(param) {
+			sc, err := parseScope(s)
+			if err != nil {
+				return nil, err
+			}
+			scopes = append(scopes, sc)
+		}
+	}
+	return scopes, nil
+}
+
+func parseScope(s string) (scope, error) {
+	// The name may contain colons, but the type and actions can't.
+	typ, rest, ok := strings.Cut(s, ":")
+	i := strings.LastIndex(rest, ":")
+	if !ok || i < 0 {
+		return scope{}, scopeError{"UNSUPPORTED", fmt.Sprintf("malformed scope %q", s)}
+	}
+	sc := scope{typ: typ, name: rest[:i]}
+	if t, class, ok := strings.Cut(typ, "("); ok {
+		if !strings.HasSuffix(class, ")") {
+			return scope{}, scopeError{"UNSUPPORTED", fmt.Sprintf("malformed resource type in scope %q", s)}
+		}
+		sc.typ, sc.class = t, strings.TrimSuffix(class, ")")
+		if !isScopeValue(sc.class) {
+			return scope{}, scopeError{"UNSUPPORTED", fmt.Sprintf("malformed resource class in scope %q", s)}
+		}
+	}
+	if !isScopeValue(sc.typ) {
+		return scope{}, scopeError{"UNSUPPORTED", fmt.Sprintf("malformed resource type in scope %q", s)}
+	}
+	if sc.name == "" {
+		return scope{}, scopeError{"NAME_INVALID", fmt.Sprintf("empty resource name in scope %q", s)}
+	}
+	if sc.typ == "repository" {
+		if err := validateRepoPath(sc.name); err != nil {
+			return scope{}, scopeError{"NAME_INVALID", fmt.Sprintf("invalid repository name in scope %q: %v", s, err)}
+		}
+	}
+	for _, a := range strings.Split(rest[i+1:], ",") {
+		if a == "" || strings.Trim(a, "abcdefghijklmnopqrstuvwxyz*") != "" {
+			return scope{}, scopeError{"UNSUPPORTED", fmt.Sprintf("malformed actions in scope %q", s)}
+		}
+		sc.actions = append(sc.actions, a)
+	}
+	return sc, nil
+}
+
+// isScopeValue reports whether s is a valid resource type or class.
+func isScopeValue(s string) bool {
+	return s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyz0123456789") == ""
+}
+
+func (s scope) String() string {
+	typ := s.typ
+	if s.class != "" {
+		typ += "(" + s.class + ")"
+	}
+	return typ + ":" + s.name + ":" + strings.Join(s.actions, ",")
+}
+
+// routeScopes returns the route serving a token request for scopes, and the
+// scopes it can serve. The route is the first routed repository's, or the
+// default route if no repositories are requested. Scopes for repositories
+// that aren't served by the route are dropped, since tokens are requested
+// from a single upstream. Other scopes are kept, since clients may have
+// access to them with their own credentials. It returns false if none of the
+// requested repositories are routed.
+func (vh vhost) routeScopes(scopes []scope) (route, []scope, bool) {
+	rt, ok := vh.defaultRoute()
+	var kept []scope
+	repos, routed := 0, false
+	for _, s := range scopes {
+		if s.typ != "repository" {
+			kept = append(kept, s)
+			continue
+		}
+		repos++
+		srt, ok := vh.match(s.name)
+		if !ok {
+			continue
+		}
+		if !routed {
+			rt, routed = srt, true
+		}
+		// Routes on a host are identified by their prefix.
+		if srt.prefix == rt.prefix {
+			kept = append(kept, s)
+		}
+	}
+	if repos > 0 && !routed {
+		return route{}, nil, false
+	}
+	return rt, kept, ok
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+func TestTokenScopes(t *testing.T) {
+	up := newFakeUpstream(t)
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes: []redirect.Route{
+			{Prefix: "unicorns", Upstream: "fake", Repo: "example"},
+			{Prefix: "other", Upstream: "fake", Repo: "elsewhere"},
+		},
+	})
+
+	for _, c := range []struct {
+		desc      string
+		scopes    []string
+		want      int
+		wantScope string
+		wantCode  string
+	}{{
+		desc:      "single",
+		scopes:    []string{"repository:unicorns/engine:pull"},
+		want:      http.StatusOK,
+		wantScope: "repository:example/engine:pull",
+	}, {
+		desc:      "several parameters",
+		scopes:    []string{"repository:unicorns/engine:pull", "repository:unicorns/cli:pull,push"},
+		want:      http.StatusOK,
+		wantScope: "repository:example/engine:pull repository:example/cli:pull,push",
+	}, {
+		desc:      "several scopes in one parameter",
+		scopes:    []string{"repository:unicorns/engine:pull repository:unicorns/cli:pull,push"},
+		want:      http.StatusOK,
+		wantScope: "repository:example/engine:pull repository:example/cli:pull,push",
+	}, {
+		desc:      "prefix elsewhere in the name",
+		scopes:    []string{"repository:unicorns/foo/unicorns/bar:pull"},
+		want:      http.StatusOK,
+		wantScope: "repository:example/foo/unicorns/bar:pull",
+	}, {
+		desc:      "mount from another route",
+		scopes:    []string{"repository:unicorns/engine:pull,push", "repository:other/engine:pull"},
+		want:      http.StatusOK,
+		wantScope: "repository:example/engine:pull,push",
+	}, {
+		desc:      "mount from an unrouted repo",
+		scopes:    []string{"repository:nope/engine:pull", "repository:unicorns/engine:pull,push"},
+		want:      http.StatusOK,
+		wantScope: "repository:example/engine:pull,push",
+	}, {
+		desc:      "other resource types",
+		scopes:    []string{"registry:catalog:*", "repository(plugin):unicorns/engine:pull"},
+		want:      http.StatusOK,
+		wantScope: "registry:catalog:* repository(plugin):example/engine:pull",
+	}, {
+		desc:      "host in another resource's name",
+		scopes:    []string{"plugin:localhost:5000/foo:pull"},
+		want:      http.StatusOK,
+		wantScope: "plugin:localhost:5000/foo:pull",
+	}, {
+		desc:     "unrouted",
+		scopes:   []string{"repository:nope/engine:pull"},
+		want:     http.StatusNotFound,
+		wantCode: "NAME_UNKNOWN",
+	}, {
+		desc:     "no actions",
+		scopes:   []string{"repository:unicorns/engine"},
+		want:     http.StatusBadRequest,
+		wantCode: "UNSUPPORTED",
+	}, {
+		desc:     "empty action",
+		scopes:   []string{"repository:unicorns/engine:pull,"},
+		want:     http.StatusBadRequest,
+		wantCode: "UNSUPPORTED",
+	}, {
+		desc:     "bad resource class",
+		scopes:   []string{"repository(plugin:unicorns/engine:pull"},
+		want:     http.StatusBadRequest,
+		wantCode: "UNSUPPORTED",
+	}, {
+		desc:     "invalid name",
+		scopes:   []string{"repository:unicorns//engine:pull"},
+		want:     http.StatusBadRequest,
+		wantCode: "NAME_INVALID",
+	}, {
+		desc:     "host in repository name",
+		scopes:   []string{"repository:localhost:5000/unicorns/engine:pull"},
+		want:     http.StatusBadRequest,
+		wantCode: "NAME_INVALID",
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			n := up.tokenRequests()
+			q := url.Values{"service": {"test"}, "scope": c.scopes}
+			resp, err := http.Get("http://" + reg + "/token?" + q.Encode())
+			if err != nil {
+				t.Fatalf("token: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.want {
+				t.Fatalf("got %s, want %d", resp.Status, c.want)
+			}
+			if c.want != http.StatusOK {
+				var body struct {
+					Errors []struct{ Code string } `json:"errors"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || len(body.Errors) != 1 || body.Errors[0].Code != c.wantCode {
+					t.Errorf("got errors %+v (%v), want code %s", body, err, c.wantCode)
+				}
+				if got := up.tokenRequests(); got != n {
+					t.Errorf("token requests: got %d, want %d", got, n)
+				}
+				return
+			}
+			if got := up.lastScope(); got != c.wantScope {
+				t.Errorf("scope: got %q, want %q", got, c.wantScope)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultTokenTTL is how long tokens last if the token response doesn't
+	// say, as specified by the distribution token spec.
+	defaultTokenTTL = 60 * time.Second
+
+	// tokenExpiryMargin is how long before they expire cached tokens stop
+	// being used, so they don't expire in flight or to clock skew.
+	tokenExpiryMargin = 5 * time.Second
+
+	// maxCachedTokens bounds the cache, which is keyed by user-visible repo
+	// and credentials.
+	maxCachedTokens = 10000
+)
+
+var (
+	// anonymousTokens caches the anonymous pull tokens the redirector
+	// requests for clients that don't send any auth, shared by every handler.
+	anonymousTokens = newTokenCache("anonymous_token_cache")
+
+	// basicTokens caches the tokens Basic credentials are exchanged for.
+	basicTokens = newTokenCache("basic_token_cache")
+)
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// tokenCache caches tokens by upstream, scope and credentials until they
+// expire. Its hits and misses are published at /debug/vars on the admin
+// server.
+type tokenCache struct {
+	mu      sync.Mutex
+	tokens  map[string]cachedToken
+	group   singleflight.Group
+	metrics *expvar.Map
+}
+
+func newTokenCache(name string) *tokenCache {
+	m := expvar.NewMap(name)
+	m.Set("hit_rate", expvar.Func(func() interface{} {
+		hits, misses := metricValue(m, "hits"), metricValue(m, "misses")
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+	return &tokenCache{tokens: map[string]cachedToken{}, metrics: m}
+}
+
+func metricValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// tokenKey identifies a token for scope on up, requested with the
+// Authorization header auth, which is hashed so the cache never holds
+// credentials.
+func tokenKey(up *upstream, scope, auth string) string {
+	key := up.Name + "\x00" + up.URL + "\x00" + scope
+	if auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		key += "\x00" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// get returns the cached token for key, or else calls fetch for a token and
+// how long it lasts, and caches it. Concurrent misses for the same token
+// share a single call to fetch.
+func (c *tokenCache) get(key string, fetch func() (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	ct, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(ct.expires) {
+		c.metrics.Add("hits", 1)
+		return ct.token, nil
+	}
+	c.metrics.Add("misses", 1)
+
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		t, ttl, err := fetch()
+		if err != nil {
+			return "", err
+		}
+		if ttl <= 0 {
+			ttl = defaultTokenTTL
+		}
+		if ttl > tokenExpiryMargin {
+			c.put(key, cachedToken{token: t, expires: time.Now().Add(ttl - tokenExpiryMargin)})
+		}
+		return t, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func (c *tokenCache) put(key string, ct cachedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.tokens) >= maxCachedTokens {
+		now := time.Now()
+		for k, v := range c.tokens {
+			if !now.Before(v.expires) {
+				delete(c.tokens, k)
+			}
+		}
+		if len(c.tokens) >= maxCachedTokens {
+			c.tokens = map[string]cachedToken{}
+		}
+	}
+	c.tokens[key] = ct
+}
+
+// forget drops the cached token for key, for example because the upstream
+// rejected it.
+func (c *tokenCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"context"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+)
+
+// headManifest requests the manifest without any auth, like containerd's
+// initial HEAD requests.
+func headManifest(t *testing.T, reg, repo, tag string) {
+	t.Helper()
+	if got := headManifestAs(t, reg, repo, tag, ""); got != http.StatusOK {
+		t.Errorf("HEAD %s:%s: got %d, want %d", repo, tag, got, http.StatusOK)
+	}
+}
+
+// headManifestAs requests the manifest with the Authorization header auth,
+// if set, and returns the response status.
+func headManifestAs(t *testing.T, reg, repo, tag, auth string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodHead, "http://"+reg+"/v2/"+repo+"/manifests/"+tag, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HEAD %s: %v", req.URL, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func basic(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func cacheHits() int64 {
+	m, ok := expvar.Get("anonymous_token_cache").(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	if v, ok := m.Get("hits").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestTokenCache(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.push(t, "example/engine", "main")
+	up.push(t, "example/cli", "main")
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+	})
+
+	hits := cacheHits()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			headManifest(t, reg, "engine", "main")
+		}()
+	}
+	wg.Wait()
+	n := up.tokenRequests()
+	if n == 0 {
+		t.Fatal("no tokens requested")
+	}
+
+	// Every request is served from the cache from now on.
+	for i := 0; i < 5; i++ {
+		headManifest(t, reg, "engine", "main")
+	}
+	if got := up.tokenRequests(); got != n {
+		t.Errorf("token requests: got %d, want %d", got, n)
+	}
+	if got := cacheHits(); got < hits+5 {
+		t.Errorf("cache hits: got %d, want at least %d", got, hits+5)
+	}
+
+	// Tokens are cached per scope.
+	headManifest(t, reg, "cli", "main")
+	if got, want := up.lastScope(), "repository:example/cli:pull"; got != want {
+		t.Errorf("scope: got %q, want %q", got, want)
+	}
+	if got := up.tokenRequests(); got != n+1 {
+		t.Errorf("token requests: got %d, want %d", got, n+1)
+	}
+}
+
+func TestTokenCacheCanceled(t *testing.T) {
+	// An upstream whose token service only responds once released.
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	var tokens *httptest.Server
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			once.Do(func() { close(started) })
+			<-release
+			fmt.Fprintln(w, `{"token":"slow"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer slow" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+tokens.URL+`/token",service="slow"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	}))
+	defer up.Close()
+	tokens = up
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "slow", URL: up.URL}},
+		Routes:    []redirect.Route{{Upstream: "slow", Repo: "example"}},
+	})
+
+	// The first client gives up while the token is being fetched.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+reg+"/v2/engine/manifests/main", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// The second one waits for the same token, which it still gets.
+	status := make(chan int)
+	go func() {
+		status <- headManifestAs(t, reg, "engine", "main", "")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("status: got %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	up := newFakeUpstream(t)
+	// Tokens that expire this soon aren't worth caching.
+	up.expiresIn = 1
+	up.push(t, "example/engine", "main")
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+	})
+
+	n := up.tokenRequests()
+	for i := 0; i < 3; i++ {
+		headManifest(t, reg, "engine", "main")
+	}
+	if got, want := up.tokenRequests(), n+3; got != want {
+		t.Errorf("token requests: got %d, want %d", got, want)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	up := newFakeUpstream(t)
+	up.passwords = map[string]string{"alice": "hunter2", "bob": "swordfish"}
+	up.push(t, "example/engine", "main")
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake", Repo: "example"}},
+	})
+
+	for _, c := range []struct {
+		desc         string
+		auth         string
+		want         int
+		wantUser     string
+		wantRequests int // new token requests
+	}{
+		{"exchanged", basic("alice", "hunter2"), http.StatusOK, "alice", 1},
+		{"cached", basic("alice", "hunter2"), http.StatusOK, "alice", 0},
+		{"cached per credentials", basic("bob", "swordfish"), http.StatusOK, "bob", 1},
+		{"lowercase scheme", "basic " + strings.TrimPrefix(basic("bob", "swordfish"), "Basic "), http.StatusOK, "bob", 1},
+		{"wrong password", basic("alice", "hunter3"), http.StatusUnauthorized, "bob", 0},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			n := up.tokenRequests()
+			if got := headManifestAs(t, reg, "engine", "main", c.auth); got != c.want {
+				t.Errorf("status: got %d, want %d", got, c.want)
+			}
+			if got := up.tokenRequests() - n; got != c.wantRequests {
+				t.Errorf("token requests: got %d, want %d", got, c.wantRequests)
+			}
+			if got := up.lastUser(); got != c.wantUser {
+				t.Errorf("token requested by %q, want %q", got, c.wantUser)
+			}
+			if got, want := up.lastScope(), "repository:example/engine:pull"; got != want {
+				t.Errorf("scope: got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"knative.dev/pkg/logging"
+)
+
+// registryError writes a distribution spec error response.
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// v2Auth serves /v2/ when the redirector issues its own tokens, challenging
+// clients without a valid token to get one from the redirector.
+func (rdr redirect) v2Auth(w http.ResponseWriter, r *http.Request) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		if _, err := rdr.issuer.verify(token); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, "{}")
+			return
+		}
+	}
+	w.Header().Set("Www-Authenticate", rdr.issuer.challenge(baseURL(r)+"/token", "", ""))
+	registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+}
+
+// issueToken serves /token when the redirector issues its own tokens,
+// granting the requested access the client is allowed.
+func (rdr redirect) issueToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	vals, post, err := tokenParams(r)
+	if err != nil {
+		logger.Infow("rejected malformed token request", "error", err)
+		oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if post {
+		// The redirector doesn't issue refresh tokens, so clients can only
+		// use the OAuth2 form flow with the credentials they'd send as
+		// Basic auth.
+		if gt := vals.Get("grant_type"); gt != "password" {
+			oauthError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("grant_type %q is not supported", gt))
+			return
+		}
+		r = r.Clone(ctx)
+		r.SetBasicAuth(vals.Get("username"), vals.Get("password"))
+	}
+
+	id, err := rdr.issuer.authenticate(r)
+	if err != nil {
+		logger.Infow("rejected token request", "error", err)
+		if post {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		w.Header().Set("Www-Authenticate", `Basic realm="`+baseURL(r)+`"`)
+		registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", err.Error())
+		return
+	}
+
+	scopes, err := parseScopes(vals["scope"])
+	if err != nil {
+		var se scopeError
+		errors.As(err, &se)
+		logger.Infow("rejected malformed scope", "error", err)
+		registryError(w, http.StatusBadRequest, se.code, se.message)
+		return
+	}
+	if rdr.certs != nil {
+		var ok bool
+		if scopes, ok = rdr.certScopes(w, r, scopes); !ok {
+			return
+		}
+	}
+	acc := []access{}
+	for _, s := range scopes {
+		// Only routed repositories can be accessed through the redirector.
+		if s.typ != "repository" || s.class != "" {
+			continue
+		}
+		if _, ok := rdr.match(s.name); !ok {
+			continue
+		}
+		acc = append(acc, access{
+			Type:    "repository",
+			Name:    s.name,
+			Actions: rdr.issuer.allowed(id, s.name, s.actions),
+		})
+	}
+
+	token, err := rdr.issuer.issue(id, acc)
+	if err != nil {
+		logger.Errorf("Error issuing token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("issued token",
+		"subject", id.subject,
+		"access", acc)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(rdr.issuer.ttl / time.Second),
+		"issued_at":    time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// authorize checks that the client is allowed to take the action r needs
+// on the repo name, either with a token issued by the redirector, or with
+// credentials it sends directly. Otherwise, it responds with a challenge and
+// returns false.
+func (rdr redirect) authorize(w http.ResponseWriter, r *http.Request, name string) bool {
+	logger := logging.FromContext(r.Context())
+	action := requiredAction(r.Method)
+	scope := "repository:" + name + ":" + action
+	if action == "push" {
+		scope = "repository:" + name + ":pull,push"
+	}
+	realm := baseURL(r) + "/token"
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		c, err := rdr.issuer.verify(token)
+		if err != nil {
+			logger.Infow("rejected token", "error", err)
+			w.Header().Set("Www-Authenticate", rdr.issuer.challenge(realm, scope, "invalid_token"))
+			registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", err.Error())
+			return false
+		}
+		if !c.permits(name, action) {
+			w.Header().Set("Www-Authenticate", rdr.issuer.challenge(realm, scope, "insufficient_scope"))
+			registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "token doesn't allow "+action+" on "+name)
+			return false
+		}
+		return true
+	}
+
+	// Clients that don't ask for a token, like containerd's initial HEAD
+	// requests, are authorized like the token they'd get.
+	id, err := rdr.issuer.authenticate(r)
+	if err == nil && len(rdr.issuer.allowed(id, name, []string{action})) == 0 {
+		err = fmt.Errorf("%s not allowed on %s", action, name)
+	}
+	if err != nil {
+		w.Header().Set("Www-Authenticate", rdr.issuer.challenge(realm, scope, ""))
+		registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", err.Error())
+		return false
+	}
+	return true
+}
+
+// jwks serves the public keys the redirector's tokens can be verified with.
+func (rdr redirect) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newJWKS(rdr.issuer.keys)) //nolint:errcheck
+}
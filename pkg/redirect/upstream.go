@@ -0,0 +1,208 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream describes a registry implementing the OCI distribution spec that
+// requests can be redirected to.
+type Upstream struct {
+	// Name identifies the upstream in routes.
+	Name string `json:"name"`
+
+	// URL is the base URL of the registry, without the /v2/ path,
+	// e.g., https://quay.io
+	URL string `json:"url"`
+
+	// TokenURL is the URL of the registry's token endpoint,
+	// e.g., https://quay.io/v2/auth
+	// If empty, it's discovered from the registry's challenge to anonymous
+	// requests, like clients do.
+	TokenURL string `json:"tokenURL,omitempty"`
+
+	// Service is the service name to request tokens for, e.g., quay.io
+	// It's only used with TokenURL; otherwise it's discovered too.
+	Service string `json:"service,omitempty"`
+
+	// RequestHeaders are set on every request sent to the registry.
+	RequestHeaders map[string]string `json:"requestHeaders,omitempty"`
+
+	// ResponseHeaders rewrite headers of the registry's responses before
+	// they're sent to clients.
+	ResponseHeaders []HeaderRewrite `json:"responseHeaders,omitempty"`
+
+	// Library is true if single-segment repo names are implicitly in the
+	// "library/" namespace, like on Docker Hub where nginx is library/nginx.
+	Library bool `json:"library,omitempty"`
+}
+
+// HeaderRewrite replaces matches of a regular expression in the values of a
+// header, like regexp.ReplaceAllString.
+type HeaderRewrite struct {
+	Header  string `json:"header"`
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// builtinUpstreams can be used by routes without being configured.
+var builtinUpstreams = []Upstream{{
+	Name: "ghcr.io",
+	URL:  "https://ghcr.io",
+}, {
+	Name: "gcr.io",
+	URL:  "https://gcr.io",
+}, {
+	// Docker Hub's API, token service and service name are all on different
+	// hosts, none of them docker.io.
+	Name:     "docker.io",
+	URL:      "https://registry-1.docker.io",
+	TokenURL: "https://auth.docker.io/token",
+	Service:  "registry.docker.io",
+	Library:  true,
+}}
+
+const defaultUpstream = "ghcr.io"
+
+// transport sends every request to upstreams. Upstreams that don't start
+// responding in time are treated like connection errors, so requests can
+// fail over to another upstream.
+var transport http.RoundTripper = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return t
+}()
+
+// client is like http.DefaultClient, but uses transport.
+var client = &http.Client{Transport: transport}
+
+// fetchTimeout bounds fetches shared by concurrent requests, like tokens,
+// which aren't canceled with the request that started them, so its client
+// going away doesn't fail every other request waiting on them.
+const fetchTimeout = 30 * time.Second
+
+// validate reports the problems with an upstream's configuration.
+func (u Upstream) validate() []string {
+	var errs []string
+	if u.Name == "" {
+		errs = append(errs, "name is required")
+	}
+	if err := validateURL(u.URL); err != nil {
+		errs = append(errs, fmt.Sprintf("url: %v", err))
+	}
+	if u.TokenURL != "" {
+		if err := validateURL(u.TokenURL); err != nil {
+			errs = append(errs, fmt.Sprintf("tokenURL: %v", err))
+		}
+	}
+	for i, hr := range u.ResponseHeaders {
+		if hr.Header == "" {
+			errs = append(errs, fmt.Sprintf("responseHeaders[%d]: header is required", i))
+		}
+		if _, err := regexp.Compile(hr.Match); err != nil {
+			errs = append(errs, fmt.Sprintf("responseHeaders[%d]: %v", i, err))
+		}
+	}
+	return errs
+}
+
+// validateURL checks that u is an absolute http or https URL.
+func validateURL(u string) error {
+	if u == "" {
+		return errors.New("is required")
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", u)
+	}
+	return nil
+}
+
+// upstream is a validated Upstream, ready to send requests to.
+type upstream struct {
+	Upstream
+	rewrites []headerRewrite
+
+	mu           sync.Mutex
+	discovered   tokenService
+	discoveredAt time.Time
+}
+
+type headerRewrite struct {
+	header  string
+	re      *regexp.Regexp
+	replace string
+}
+
+func newUpstream(u Upstream) *upstream {
+	up := &upstream{Upstream: u}
+	up.URL = strings.TrimSuffix(u.URL, "/")
+	for _, hr := range u.ResponseHeaders {
+		up.rewrites = append(up.rewrites, headerRewrite{
+			header:  http.CanonicalHeaderKey(hr.Header),
+			re:      regexp.MustCompile(hr.Match),
+			replace: hr.Replace,
+		})
+	}
+	return up
+}
+
+// newUpstreams returns every builtin and configured upstream, by name.
+// Configured upstreams override builtin upstreams with the same name.
+func newUpstreams(cfg Config) map[string]*upstream {
+	ups := map[string]*upstream{}
+	for _, u := range builtinUpstreams {
+		ups[u.Name] = newUpstream(u)
+	}
+	for _, u := range cfg.Upstreams {
+		ups[u.Name] = newUpstream(u)
+	}
+	return ups
+}
+
+// v2URL returns the URL of path under the registry's /v2/ API.
+func (u *upstream) v2URL(path string) string {
+	return u.URL + "/v2/" + path
+}
+
+// newRequest returns a request to the registry, with the client's headers
+// if any, and the registry's configured request headers.
+func (u *upstream) newRequest(method, url string, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	for k, v := range u.RequestHeaders {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// rewriteHeader applies the registry's configured response header rewrites
+// to a single header value.
+func (u *upstream) rewriteHeader(k, v string) string {
+	for _, hr := range u.rewrites {
+		if hr.header == k {
+			v = hr.re.ReplaceAllString(v, hr.replace)
+		}
+	}
+	return v
+}
@@ -0,0 +1,427 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redirect_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chainguard-dev/registry-redirect/pkg/redirect"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// fakeUpstream serves an in-memory registry that requires bearer tokens
+// issued by a token service on another host.
+type fakeUpstream struct {
+	*httptest.Server
+	tokens *httptest.Server
+
+	// expiresIn is the lifetime of issued tokens, in seconds, if set.
+	expiresIn int
+	// passwords are the Basic credentials the token service accepts, by
+	// username.
+	passwords map[string]string
+
+	mu sync.Mutex
+	// scopes records the scope of every token requested, joined by spaces if
+	// there were several.
+	scopes []string
+	// users records the user every token was requested by, or "" if it was
+	// requested anonymously.
+	users []string
+	// method and params are the method and query or form of the last token
+	// request.
+	method string
+	params url.Values
+	// uploads records the query of every upload started.
+	uploads []url.Values
+}
+
+// lastUpload returns the query of the last upload started.
+func (f *fakeUpstream) lastUpload() url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.uploads) == 0 {
+		return nil
+	}
+	return f.uploads[len(f.uploads)-1]
+}
+
+// lastRequest returns the method and params of the last token request.
+func (f *fakeUpstream) lastRequest() (string, url.Values) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.method, f.params
+}
+
+// lastUser returns the user the last token was requested by.
+func (f *fakeUpstream) lastUser() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.users) == 0 {
+		return ""
+	}
+	return f.users[len(f.users)-1]
+}
+
+// tokenRequests returns how many tokens have been requested.
+func (f *fakeUpstream) tokenRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.scopes)
+}
+
+// lastScope returns the scope of the last token requested.
+func (f *fakeUpstream) lastScope() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.scopes) == 0 {
+		return ""
+	}
+	return f.scopes[len(f.scopes)-1]
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	t.Helper()
+	f := &fakeUpstream{}
+	reg := registry.New(registry.Logger(nopLogger))
+	f.tokens = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		user, pass, ok := r.BasicAuth()
+		if ok && (f.passwords[user] == "" || f.passwords[user] != pass) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp := map[string]interface{}{}
+		if r.Method == http.MethodPost {
+			// The OAuth2 form flow, which issues access_token and, if asked,
+			// refresh tokens, like Docker Hub's.
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			params = r.PostForm
+			switch params.Get("grant_type") {
+			case "password":
+				user = params.Get("username")
+				if f.passwords[user] == "" || f.passwords[user] != params.Get("password") {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			case "refresh_token":
+				user = strings.TrimPrefix(params.Get("refresh_token"), "fake-refresh-for-")
+				if f.passwords[user] == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		// Refresh tokens are issued if asked for, by the OAuth2 form flow or
+		// by GET requests with offline_token, like Docker Hub does.
+		if user != "" && (params.Get("access_type") == "offline" || params.Get("offline_token") == "true") {
+			resp["refresh_token"] = "fake-refresh-for-" + user
+		}
+		scope := strings.Join(params["scope"], " ")
+		f.mu.Lock()
+		f.scopes = append(f.scopes, scope)
+		f.users = append(f.users, user)
+		f.method, f.params = r.Method, params
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			resp["access_token"] = "fake-token-for-" + scope
+		} else {
+			resp["token"] = "fake-token-for-" + scope
+		}
+		if f.expiresIn != 0 {
+			resp["expires_in"] = f.expiresIn
+		}
+		json.NewEncoder(w).Encode(resp) //nolint:errcheck
+	}))
+	t.Cleanup(f.tokens.Close)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer fake-token-for-") {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/auth/token",service="fake",scope="repository:a,b:pull"`, f.tokens.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+			f.mu.Lock()
+			f.uploads = append(f.uploads, r.URL.Query())
+			f.mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// upstream returns the config for an upstream named name pointing at f.
+func (f *fakeUpstream) upstream(name string) redirect.Upstream {
+	return redirect.Upstream{
+		Name: name,
+		URL:  f.URL,
+	}
+}
+
+// push pushes a random image to repo:tag on f, returning its digest.
+func (f *fakeUpstream) push(t *testing.T, repo, tag string) string {
+	t.Helper()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	ref := fmt.Sprintf("%s/%s:%s", strings.TrimPrefix(f.URL, "http://"), repo, tag)
+	if err := crane.Push(img, ref); err != nil {
+		t.Fatalf("crane.Push(%s): %v", ref, err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	return d.String()
+}
+
+var nopLogger = log.New(io.Discard, "", 0)
+
+// newBasicUpstream serves an in-memory registry that, like registries behind
+// htpasswd, challenges clients for user's Basic credentials, and has no token
+// service.
+func newBasicUpstream(t *testing.T, user, pass string) *httptest.Server {
+	t.Helper()
+	reg := registry.New(registry.Logger(nopLogger))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != pass {
+			w.Header().Set("Www-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// forwardedHTTP tells the redirector that clients reach it over plain HTTP,
+// so token realms point at the test server.
+type forwardedHTTP struct{}
+
+func (forwardedHTTP) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Forwarded-Proto", "http")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newRedirector serves cfg, returning the registry host clients should use.
+func newRedirector(t *testing.T, cfg redirect.Config, opts ...redirect.Option) string {
+	t.Helper()
+	h, err := redirect.NewFromConfig(cfg, opts...)
+	if err != nil {
+		t.Fatalf("NewFromConfig: %v", err)
+	}
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func TestUpstream(t *testing.T) {
+	up := newFakeUpstream(t)
+	want := up.push(t, "example/engine", "main")
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes: []redirect.Route{
+			{Prefix: "unicorns", Upstream: "fake", Repo: "example"},
+		},
+	})
+	opt := crane.WithTransport(forwardedHTTP{})
+
+	got, err := crane.Digest(reg+"/unicorns/engine:main", opt)
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+	if _, err := crane.Manifest(reg+"/unicorns/engine:main", opt); err != nil {
+		t.Errorf("manifest: %v", err)
+	}
+	tags, err := crane.ListTags(reg+"/unicorns/engine", opt)
+	if err != nil {
+		t.Errorf("listing tags: %v", err)
+	}
+	if len(tags) != 1 || tags[0] != "main" {
+		t.Errorf("got tags %v, want [main]", tags)
+	}
+	if last := up.lastScope(); last != "repository:example/engine:pull" {
+		t.Errorf("got upstream scope %q, want repository:example/engine:pull", last)
+	}
+}
+
+func TestLibraryNamespace(t *testing.T) {
+	up := newFakeUpstream(t)
+	want := up.push(t, "library/nginx", "latest")
+	hub := up.upstream("hub")
+	hub.Library = true
+
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{hub},
+		Routes:    []redirect.Route{{Prefix: "hub", Upstream: "hub"}},
+	})
+	opt := crane.WithTransport(forwardedHTTP{})
+
+	got, err := crane.Digest(reg+"/hub/nginx:latest", opt)
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+	if last := up.lastScope(); last != "repository:library/nginx:pull" {
+		t.Errorf("got upstream scope %q, want repository:library/nginx:pull", last)
+	}
+	if _, err := crane.ListTags(reg+"/hub/nginx", opt); err != nil {
+		t.Errorf("listing tags: %v", err)
+	}
+}
+
+func TestChallengeRewrite(t *testing.T) {
+	up := newFakeUpstream(t)
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{up.upstream("fake")},
+		Routes:    []redirect.Route{{Upstream: "fake"}},
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+reg+"/v2/", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Host = "example.dev"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	want := `Bearer realm="https://example.dev/token",service="fake",scope="repository:a,b:pull"`
+	if got := resp.Header.Get("Www-Authenticate"); got != want {
+		t.Errorf("got Www-Authenticate %s, want %s", got, want)
+	}
+}
+
+func TestBasicUpstream(t *testing.T) {
+	up := newBasicUpstream(t, "alice", "hunter2")
+	reg := newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "basic", URL: up.URL}},
+		Routes:    []redirect.Route{{Upstream: "basic", Repo: "example"}},
+	})
+
+	// The upstream has no token service, so anonymous clients get its own
+	// challenge.
+	for _, path := range []string{"/v2/", "/v2/engine/manifests/main"} {
+		resp, err := http.Get("http://" + reg + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s: got status %d, want %d", path, resp.StatusCode, http.StatusUnauthorized)
+		}
+		if got, want := resp.Header.Get("Www-Authenticate"), `Basic realm="registry"`; got != want {
+			t.Errorf("GET %s: got Www-Authenticate %q, want %q", path, got, want)
+		}
+	}
+
+	// Clients' Basic credentials are passed on as they are, rather than
+	// exchanged for a token.
+	ref := strings.TrimPrefix(up.URL, "http://") + "/example/engine:main"
+	auth := crane.WithAuth(&authn.Basic{Username: "alice", Password: "hunter2"})
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	if err := crane.Push(img, ref, auth); err != nil {
+		t.Fatalf("crane.Push(%s): %v", ref, err)
+	}
+	for _, c := range []struct {
+		desc string
+		auth string
+		want int
+	}{
+		{"valid credentials", basic("alice", "hunter2"), http.StatusOK},
+		{"wrong password", basic("alice", "wrong"), http.StatusUnauthorized},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			if got := headManifestAs(t, reg, "engine", "main", c.auth); got != c.want {
+				t.Errorf("manifest: got status %d, want %d", got, c.want)
+			}
+			req, err := http.NewRequest(http.MethodGet, "http://"+reg+"/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", c.auth)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET /v2/: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.want {
+				t.Errorf("GET /v2/: got status %d, want %d", resp.StatusCode, c.want)
+			}
+		})
+	}
+
+	// So are the route's credentials, for anonymous clients.
+	t.Setenv("REDIRECT_TEST_PASSWORD", "hunter2")
+	reg = newRedirector(t, redirect.Config{
+		Upstreams: []redirect.Upstream{{Name: "basic", URL: up.URL}},
+		Routes: []redirect.Route{{
+			Upstream:    "basic",
+			Repo:        "example",
+			Credentials: &redirect.Credentials{Username: "alice", PasswordEnv: "REDIRECT_TEST_PASSWORD"},
+		}},
+	})
+	headManifest(t, reg, "engine", "main")
+}
+
+func TestUpstreamValidation(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		up      redirect.Upstream
+		wantErr string
+	}{
+		{"missing url", redirect.Upstream{Name: "x", TokenURL: "https://x/token"}, "url: is required"},
+		{"relative token url", redirect.Upstream{Name: "x", URL: "https://x", TokenURL: "/token"}, `"/token" is not an absolute`},
+		{"bad rewrite", redirect.Upstream{Name: "x", URL: "https://x", TokenURL: "https://x/token",
+			ResponseHeaders: []redirect.HeaderRewrite{{Header: "Link", Match: "("}}}, "responseHeaders[0]"},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := redirect.Config{
+				Upstreams: []redirect.Upstream{c.up},
+				Routes:    []redirect.Route{{Upstream: "x"}},
+			}.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("Validate: got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}